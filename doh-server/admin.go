@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// adminHandler serves the administrative endpoints on admin_listen. GET
+// /status is deliberately left open to health checks and monitoring, it only
+// reports upstream health and cache counters.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.statusHandler)
+	mux.HandleFunc("GET /cache", s.requireAdminToken(s.cacheInspectHandler))
+	mux.HandleFunc("GET /cache/top", s.requireAdminToken(s.cacheTopHandler))
+	mux.HandleFunc("POST /cache/purge", s.requireAdminToken(s.cachePurgeHandler))
+	mux.HandleFunc("POST /cache/flush", s.requireAdminToken(s.cacheFlushHandler))
+	return mux
+}
+
+type serverStatus struct {
+	Version   string           `json:"version"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+	Cache     CacheStats       `json:"cache"`
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	state := s.state.Load()
+	status := serverStatus{
+		Version:   VERSION,
+		Upstreams: make([]upstreamStatus, 0, len(state.upstreams)),
+		Cache:     s.cache.Stats(),
+	}
+	for _, u := range state.upstreams {
+		status.Upstreams = append(status.Upstreams, u.health.status(u.name))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// requireAdminToken lets through requests carrying admin_token as bearer
+// token. Without admin_token, the endpoints behind it are disabled.
+func (s *Server) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.state.Load().conf.AdminToken
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, adminError{"admin_token is not set"})
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, adminError{"invalid or missing bearer token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+type cacheEntryStatus struct {
+	Key string `json:"key"`
+	// TTL is the number of seconds the entry stays fresh, 0 once stale.
+	TTL int `json:"ttl"`
+	// ExpiresIn is the number of seconds until the entry is removed.
+	ExpiresIn int       `json:"expires_in"`
+	StoredAt  time.Time `json:"stored_at"`
+	Rcode     string    `json:"rcode"`
+	Answer    []string  `json:"answer"`
+	Authority []string  `json:"authority"`
+}
+
+// cacheInspectHandler returns the cache entries for a query given by the
+// name, type, do, cd and subnet parameters, the latter being an ECS source
+// prefix such as 198.51.100.0/24.
+func (s *Server) cacheInspectHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	name, ok := adminDomainName(w, params.Get("name"))
+	if !ok {
+		return
+	}
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			writeJSON(w, http.StatusBadRequest, adminError{"unknown type " + strconv.Quote(t)})
+			return
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.CheckingDisabled, _ = strconv.ParseBool(params.Get("cd"))
+	do, _ := strconv.ParseBool(params.Get("do"))
+	if do || params.Has("subnet") {
+		msg.SetEdns0(dns.DefaultMsgSize, do)
+	}
+	if subnet := params.Get("subnet"); subnet != "" {
+		_, prefix, err := net.ParseCIDR(subnet)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid subnet " + strconv.Quote(subnet)})
+			return
+		}
+		ones, _ := prefix.Mask.Size()
+		option := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: prefix.IP}
+		if prefix.IP.To4() == nil {
+			option.Family = 2
+		}
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, option)
+	}
+
+	keys, _ := newCacheKeys(msg)
+	now := time.Now()
+	entries := []cacheEntryStatus{}
+	for _, key := range keys.lookup() {
+		entry, remaining, err := s.cache.Peek(r.Context(), key)
+		if err != nil {
+			continue
+		}
+		storedAt, ttl, err := cacheEntryHeader(entry)
+		if err != nil {
+			continue
+		}
+		cached, _, err := unpackCacheEntry(entry, now)
+		if err != nil {
+			continue
+		}
+		status := cacheEntryStatus{
+			Key:       key,
+			TTL:       max(int(storedAt.Add(time.Duration(ttl)*time.Second).Sub(now)/time.Second), 0),
+			ExpiresIn: int(remaining / time.Second),
+			StoredAt:  storedAt,
+			Rcode:     dns.RcodeToString[cached.Rcode],
+			Answer:    []string{},
+			Authority: []string{},
+		}
+		for _, rr := range cached.Answer {
+			status.Answer = append(status.Answer, rr.String())
+		}
+		for _, rr := range cached.Ns {
+			status.Authority = append(status.Authority, rr.String())
+		}
+		entries = append(entries, status)
+	}
+
+	code := http.StatusOK
+	if len(entries) == 0 {
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, map[string][]cacheEntryStatus{"entries": entries})
+}
+
+// Number of names /cache/top returns by default.
+const defaultTopNames = 1000
+
+// cacheTopHandler returns the names queried most in the last one to two
+// minutes, at most limit of them, in the format of warmup_file.
+func (s *Server) cacheTopHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTopNames
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid limit " + strconv.Quote(l)})
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, q := range s.hits.top(limit, time.Now()) {
+		fmt.Fprintf(w, "%s %s\n", q.Name, dns.Type(q.Qtype))
+	}
+}
+
+// cachePurgeHandler removes every cache entry for the name parameter, only
+// those of the type parameter if given, or every entry for names under the
+// suffix parameter, the suffix itself included.
+func (s *Server) cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var patterns []string
+	switch {
+	case params.Has("name"):
+		name, ok := adminDomainName(w, params.Get("name"))
+		if !ok {
+			return
+		}
+		pattern := "dns:" + escapeGlob(name) + ":"
+		if t := params.Get("type"); t != "" {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, adminError{"unknown type " + strconv.Quote(t)})
+				return
+			}
+			pattern += strconv.Itoa(int(qtype)) + ":"
+		}
+		patterns = []string{pattern + "*"}
+	case params.Has("suffix"):
+		suffix, ok := adminDomainName(w, params.Get("suffix"))
+		if !ok {
+			return
+		}
+		if suffix == "." {
+			writeJSON(w, http.StatusBadRequest, adminError{"use /cache/flush to purge everything"})
+			return
+		}
+		patterns = []string{
+			"dns:" + escapeGlob(suffix) + ":*",
+			"dns:*." + escapeGlob(suffix) + ":*",
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, adminError{"name or suffix parameter required"})
+		return
+	}
+	s.purgeCache(w, r, patterns...)
+}
+
+// cacheFlushHandler removes every cache entry, and nothing else stored in the
+// same Redis database.
+func (s *Server) cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	s.purgeCache(w, r, "dns:*")
+}
+
+func (s *Server) purgeCache(w http.ResponseWriter, r *http.Request, patterns ...string) {
+	n, err := s.cache.Purge(r.Context(), patterns...)
+	if err != nil {
+		log.Printf("Purging cache entries matching %q failed: %v", patterns, err)
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	log.Printf("Purged %d cache entries matching %q", n, patterns)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// adminDomainName returns name as it appears in cache keys, or writes an
+// error if it is not a domain name.
+func adminDomainName(w http.ResponseWriter, name string) (string, bool) {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid domain name " + strconv.Quote(name)})
+		return "", false
+	}
+	return strings.ToLower(dns.Fqdn(name)), true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write to client: %v\n", err)
+	}
+}
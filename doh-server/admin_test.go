@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheAdminEndpoints(t *testing.T) {
+	t.Parallel()
+	server := &Server{cache: newMemoryCache(100)}
+	state := newTestState(t, "random", "udp:192.0.2.1:53")
+	state.conf.AdminToken = "s3cret"
+	server.state.Store(state)
+	handler := server.adminHandler()
+
+	store := func(name string, qtype uint16) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		keys, _ := newCacheKeys(msg)
+		response := testResponse(300, 300)
+		response.Question = msg.Question
+		server.cacheResponse(t.Context(), keys, response, false)
+	}
+	for _, name := range []string{"example.com.", "www.example.com.", "a.b.example.com.", "notexample.com.", "example.org."} {
+		store(name, dns.TypeA)
+		store(name, dns.TypeAAAA)
+	}
+
+	do := func(method, target, token string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+		return w.Code, body
+	}
+
+	if code, _ := do("GET", "/cache?name=example.com", ""); code != http.StatusUnauthorized {
+		t.Errorf("request without token: status %d", code)
+	}
+	if code, _ := do("POST", "/cache/flush", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("request with wrong token: status %d", code)
+	}
+
+	code, body := do("GET", "/cache?name=WWW.example.com&type=aaaa", "s3cret")
+	entries, _ := body["entries"].([]any)
+	if code != http.StatusOK || len(entries) != 1 {
+		t.Fatalf("inspect: status %d, body %v", code, body)
+	}
+	entry := entries[0].(map[string]any)
+	if entry["key"] != "dns:www.example.com.:28:1:do=0:cd=0" || entry["ttl"].(float64) <= 0 || entry["rcode"] != "NOERROR" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+	if code, _ := do("GET", "/cache?name=www.example.com&do=1", "s3cret"); code != http.StatusNotFound {
+		t.Errorf("inspect of an uncached DO variant: status %d", code)
+	}
+
+	purged := func(target string) float64 {
+		t.Helper()
+		code, body := do("POST", target, "s3cret")
+		if code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %v", target, code, body)
+		}
+		return body["purged"].(float64)
+	}
+	if n := purged("/cache/purge?name=example.org&type=AAAA"); n != 1 {
+		t.Errorf("purged %v entries for one name and type, want 1", n)
+	}
+	if n := purged("/cache/purge?name=example.org"); n != 1 {
+		t.Errorf("purged %v entries for one name, want 1", n)
+	}
+	if n := purged("/cache/purge?suffix=example.com"); n != 6 {
+		t.Errorf("purged %v entries under example.com, want 6", n)
+	}
+	if code, _ := do("GET", "/cache?name=notexample.com", "s3cret"); code != http.StatusOK {
+		t.Error("suffix purge removed a name outside the suffix")
+	}
+	if n := purged("/cache/flush"); n != 2 {
+		t.Errorf("flushed %v entries, want 2", n)
+	}
+
+	for _, target := range []string{"/cache/purge", "/cache/purge?suffix=.", "/cache/purge?name=exa..mple"} {
+		if code, _ := do("POST", target, "s3cret"); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, code)
+		}
+	}
+
+	state.conf.AdminToken = ""
+	if code, _ := do("POST", "/cache/flush", "s3cret"); code != http.StatusForbidden {
+		t.Errorf("request without admin_token: status %d", code)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"dns:*", "dns:example.com.:1:1:do=0:cd=0", true},
+		{"dns:*.example.com.:*", "dns:www.example.com.:1:1:do=0:cd=0", true},
+		{"dns:*.example.com.:*", "dns:notexample.com.:1:1:do=0:cd=0", false},
+		{"dns:example.com.:1:*", "dns:example.com.:1:1:do=0:cd=0:ecs=198.51.100.0/24", true},
+		{"dns:example.com.:1:*", "dns:example.com.:16:1:do=0:cd=0", false},
+		{"dns:a?c", "dns:abc", true},
+		{"dns:" + escapeGlob("a*c"), "dns:abc", false},
+		{"dns:" + escapeGlob("a*c"), "dns:a*c", true},
+	} {
+		if got := globMatch(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v", tc.pattern, tc.key, got)
+		}
+	}
+}
+
+func TestAdminListenerTLS(t *testing.T) {
+	t.Parallel()
+	certFile, keyFile := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{cache: noopCache{}}
+	state := newTestState(t, "random", "udp:192.0.2.1:53")
+	state.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.state.Store(state)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	go server.listenHTTP(addr, server.adminHandler(), true)
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.CloseIdleConnections()
+	for range 50 {
+		resp, err := client.Get("https://" + addr + "/status")
+		if err != nil {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET /status = %d", resp.StatusCode)
+		}
+		return
+	}
+	t.Error("admin endpoint not served over HTTPS")
+}
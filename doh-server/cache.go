@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A cache entry is the packed response, prefixed with cacheEntryVersion, the
+// Unix time it was stored at and its lifetime in seconds.
+const (
+	cacheEntryVersion   = 1
+	cacheEntryHeaderLen = 1 + 8 + 4
+)
+
+var errInvalidCacheEntry = errors.New("invalid cache entry")
+
+// cacheKeys are the keys the response to a query may be cached under. Both
+// include the name, type and class of the question and the DO and CD bits,
+// which change what upstreams answer.
+type cacheKeys struct {
+	// global is the key of responses valid for every client.
+	global string
+	// subnet is the key of responses tailored to the EDNS Client Subnet of
+	// the query, which upstreams mark with a non-zero scope (RFC 7871 section
+	// 7.3). It is empty if the query has no ECS source prefix.
+	subnet string
+}
+
+// newCacheKeys returns the cache keys of msg, or false if msg has no question.
+func newCacheKeys(msg *dns.Msg) (cacheKeys, bool) {
+	if len(msg.Question) == 0 {
+		return cacheKeys{}, false
+	}
+	q := msg.Question[0]
+	var do, cd int
+	if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+		do = 1
+	}
+	if msg.CheckingDisabled {
+		cd = 1
+	}
+	keys := cacheKeys{
+		global: fmt.Sprintf("dns:%s:%d:%d:do=%d:cd=%d", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, cd),
+	}
+	if subnet := ecsOption(msg); subnet != nil && subnet.SourceNetmask > 0 {
+		bits := net.IPv4len * 8
+		if subnet.Family == 2 {
+			bits = net.IPv6len * 8
+		}
+		prefix := subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+		keys.subnet = fmt.Sprintf("%s:ecs=%s/%d", keys.global, prefix, subnet.SourceNetmask)
+	}
+	return keys, true
+}
+
+// lookup returns the keys to look a response up under, in order.
+func (k cacheKeys) lookup() []string {
+	if k.subnet == "" {
+		return []string{k.global}
+	}
+	return []string{k.global, k.subnet}
+}
+
+// flight returns the key identical queries in flight are coalesced by.
+func (k cacheKeys) flight() string {
+	return cmp.Or(k.subnet, k.global)
+}
+
+// forResponse returns the key to cache response under.
+func (k cacheKeys) forResponse(response *dns.Msg) string {
+	if subnet := ecsOption(response); k.subnet != "" && subnet != nil && subnet.SourceScope > 0 {
+		return k.subnet
+	}
+	return k.global
+}
+
+func ecsOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// cacheTTL returns how long response may be cached: the lowest TTL of its
+// answer and authority records, clamped to cache_min_ttl and cache_max_ttl.
+// Negative responses are cached for the lower of the TTL and MINIMUM field of
+// the SOA record in their authority section (RFC 2308 section 5), capped at
+// cache_negative_max_ttl. 0 means the response must not be cached.
+func cacheTTL(conf *config, response *dns.Msg) uint32 {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	ttl := ^uint32(0)
+	for _, rr := range response.Answer {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	if isNegative(response) {
+		soa := negativeSOA(response)
+		if soa == nil {
+			// Without SOA there is no negative TTL to go by.
+			return 0
+		}
+		ttl = min(ttl, soa.Hdr.Ttl, soa.Minttl)
+		return min(clampTTL(ttl, conf), uint32(conf.CacheNegativeMaxTTL))
+	}
+	for _, rr := range response.Ns {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return clampTTL(ttl, conf)
+}
+
+// isNegative reports whether response is an NXDOMAIN or NODATA answer.
+func isNegative(response *dns.Msg) bool {
+	return response.Rcode == dns.RcodeNameError || len(response.Answer) == 0
+}
+
+func negativeSOA(response *dns.Msg) *dns.SOA {
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+func clampTTL(ttl uint32, conf *config) uint32 {
+	return min(max(ttl, uint32(conf.CacheMinTTL)), uint32(conf.CacheMaxTTL))
+}
+
+// packCacheEntry packs response for the cache. The TTLs of its records are
+// clamped like the lifetime of the entry, so that clients do not come back
+// before, or long after, the entry expires. The SOA record of a negative
+// response gets the negative TTL, as resolvers cache it for its TTL.
+func packCacheEntry(conf *config, response *dns.Msg, ttl uint32, now time.Time) ([]byte, error) {
+	response = response.Copy()
+	forEachTTL(response, func(hdr *dns.RR_Header) {
+		hdr.Ttl = clampTTL(hdr.Ttl, conf)
+	})
+	if isNegative(response) {
+		if soa := negativeSOA(response); soa != nil {
+			soa.Hdr.Ttl = ttl
+		}
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+	entry := make([]byte, cacheEntryHeaderLen, cacheEntryHeaderLen+len(packed))
+	entry[0] = cacheEntryVersion
+	binary.BigEndian.PutUint64(entry[1:], uint64(now.Unix()))
+	binary.BigEndian.PutUint32(entry[9:], ttl)
+	return append(entry, packed...), nil
+}
+
+// unpackCacheEntry unpacks a cache entry, decrementing the TTLs of its
+// records by the age of the entry, down to 0. fresh is false once the entry
+// outlived its TTL and is only kept for serving stale.
+func unpackCacheEntry(entry []byte, now time.Time) (msg *dns.Msg, fresh bool, err error) {
+	storedAt, ttl, err := cacheEntryHeader(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	msg = new(dns.Msg)
+	if err := msg.Unpack(entry[cacheEntryHeaderLen:]); err != nil {
+		return nil, false, err
+	}
+	age := uint32(max(now.Sub(storedAt), 0) / time.Second)
+	forEachTTL(msg, func(hdr *dns.RR_Header) {
+		hdr.Ttl -= min(hdr.Ttl, age)
+	})
+	return msg, age < ttl, nil
+}
+
+// cacheEntryHeader returns when entry was stored and its lifetime in seconds.
+func cacheEntryHeader(entry []byte) (storedAt time.Time, ttl uint32, err error) {
+	if len(entry) < cacheEntryHeaderLen || entry[0] != cacheEntryVersion {
+		return time.Time{}, 0, errInvalidCacheEntry
+	}
+	storedAt = time.Unix(int64(binary.BigEndian.Uint64(entry[1:])), 0)
+	return storedAt, binary.BigEndian.Uint32(entry[9:]), nil
+}
+
+// TTL of the records of stale answers, as recommended by RFC 8767 section 4.
+const staleAnswerTTL = 30
+
+// markStale prepares msg, an expired cache entry, to be served: its TTLs are
+// set to staleAnswerTTL and, if the client speaks EDNS, an Extended DNS Error
+// tells it the answer is stale (RFC 8914 section 4.4).
+func markStale(msg *dns.Msg) {
+	forEachTTL(msg, func(hdr *dns.RR_Header) {
+		hdr.Ttl = staleAnswerTTL
+	})
+	if opt := msg.IsEdns0(); opt != nil {
+		code := dns.ExtendedErrorCodeStaleAnswer
+		if msg.Rcode == dns.RcodeNameError {
+			code = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code})
+	}
+}
+
+// forEachTTL calls f with the header of every record of msg carrying a TTL,
+// which excludes the OPT pseudo-record.
+func forEachTTL(msg *dns.Msg, f func(hdr *dns.RR_Header)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				f(rr.Header())
+			}
+		}
+	}
+}
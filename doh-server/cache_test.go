@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testResponse(answerTTL, authorityTTL uint32) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	msg.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: answerTTL},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	msg.Ns = []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: authorityTTL},
+		Ns:  "ns.example.com.",
+	}}
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	return msg
+}
+
+func TestCacheTTL(t *testing.T) {
+	t.Parallel()
+	conf := defaultConfig()
+	conf.CacheMinTTL = 60
+	conf.CacheMaxTTL = 3600
+
+	for _, tc := range []struct {
+		answerTTL, authorityTTL uint32
+		want                    uint32
+	}{
+		{300, 600, 300},
+		{600, 300, 300},
+		{10, 600, 60},
+		{86400, 86400, 3600},
+	} {
+		if got := cacheTTL(conf, testResponse(tc.answerTTL, tc.authorityTTL)); got != tc.want {
+			t.Errorf("cacheTTL(%d, %d) = %d, want %d", tc.answerTTL, tc.authorityTTL, got, tc.want)
+		}
+	}
+
+	nxdomain := testResponse(300, 300)
+	nxdomain.Rcode = dns.RcodeNameError
+	if got := cacheTTL(conf, nxdomain); got != 0 {
+		t.Errorf("cacheTTL(NXDOMAIN) = %d, want 0", got)
+	}
+}
+
+func TestCacheEntryAging(t *testing.T) {
+	t.Parallel()
+	conf := defaultConfig()
+	conf.CacheMinTTL = 60
+	response := testResponse(30, 600)
+	now := time.Now()
+
+	entry, err := packCacheEntry(conf, response, cacheTTL(conf, response), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Answer[0].Header().Ttl != 30 {
+		t.Error("packCacheEntry modified the response")
+	}
+
+	msg, fresh, err := unpackCacheEntry(entry, now.Add(45*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh {
+		t.Error("entry expired after 45s, want a lifetime of 60s")
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 15 {
+		t.Errorf("answer TTL after 45s = %d, want 60-45", ttl)
+	}
+	if ttl := msg.Ns[0].Header().Ttl; ttl != 555 {
+		t.Errorf("authority TTL after 45s = %d, want 600-45", ttl)
+	}
+	if opt := msg.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("OPT record was not preserved")
+	}
+
+	msg, fresh, err = unpackCacheEntry(entry, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh {
+		t.Error("entry still fresh after an hour")
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("answer TTL after an hour = %d, want 0", ttl)
+	}
+
+	markStale(msg)
+	if ttl := msg.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("stale answer TTL = %d, want %d", ttl, staleAnswerTTL)
+	}
+	var ede *dns.EDNS0_EDE
+	for _, option := range msg.IsEdns0().Option {
+		if option, ok := option.(*dns.EDNS0_EDE); ok {
+			ede = option
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("stale answer carries EDE %v, want Stale Answer", ede)
+	}
+
+	raw, _ := response.Pack()
+	if _, _, err := unpackCacheEntry(raw, now); err == nil {
+		t.Error("expected an entry without header to be rejected")
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	t.Parallel()
+	query := func(do, cd bool, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Example.COM.", dns.TypeA)
+		msg.CheckingDisabled = cd
+		msg.SetEdns0(dns.DefaultMsgSize, do)
+		if subnet != nil {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
+		}
+		return msg
+	}
+
+	keys, ok := newCacheKeys(query(false, false, nil))
+	if !ok || keys.global != "dns:example.com.:1:1:do=0:cd=0" || keys.subnet != "" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	seen := map[string]bool{keys.global: true}
+	for _, msg := range []*dns.Msg{query(true, false, nil), query(false, true, nil), query(true, true, nil)} {
+		keys, _ := newCacheKeys(msg)
+		if seen[keys.global] {
+			t.Errorf("key %q used for different DO and CD bits", keys.global)
+		}
+		seen[keys.global] = true
+	}
+
+	chaos := query(false, false, nil)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	if keys, _ := newCacheKeys(chaos); seen[keys.global] {
+		t.Errorf("key %q used for different classes", keys.global)
+	}
+
+	keys, _ = newCacheKeys(query(false, false, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(198, 51, 100, 7),
+	}))
+	if keys.subnet != "dns:example.com.:1:1:do=0:cd=0:ecs=198.51.100.0/24" {
+		t.Errorf("unexpected subnet key %q", keys.subnet)
+	}
+	if keys, _ := newCacheKeys(query(false, false, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 56, Address: net.ParseIP("2001:db8:1:2ff::1"),
+	})); keys.subnet != "dns:example.com.:1:1:do=0:cd=0:ecs=2001:db8:1:200::/56" {
+		t.Errorf("unexpected subnet key %q", keys.subnet)
+	}
+
+	global := testResponse(300, 300)
+	tailored := testResponse(300, 300)
+	tailored.IsEdns0().Option = append(tailored.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.IPv4(198, 51, 100, 0),
+	})
+	if key := keys.forResponse(global); key != keys.global {
+		t.Errorf("response without scope cached under %q", key)
+	}
+	if key := keys.forResponse(tailored); key != keys.subnet {
+		t.Errorf("response with scope cached under %q", key)
+	}
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	t.Parallel()
+	conf := defaultConfig()
+	conf.CacheNegativeMaxTTL = 900
+	negative := func(rcode int, soaTTL, minTTL uint32) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("nonexistent.example.com.", dns.TypeAAAA)
+		msg.Response = true
+		msg.Rcode = rcode
+		msg.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: minTTL,
+		}}
+		return msg
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  *dns.Msg
+		want uint32
+	}{
+		{"NXDOMAIN", negative(dns.RcodeNameError, 3600, 300), 300},
+		{"NODATA", negative(dns.RcodeSuccess, 60, 300), 60},
+		{"capped", negative(dns.RcodeNameError, 86400, 86400), 900},
+		{"without SOA", &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, 0},
+		{"SERVFAIL", negative(dns.RcodeServerFailure, 3600, 300), 0},
+	} {
+		if got := cacheTTL(conf, tc.msg); got != tc.want {
+			t.Errorf("%s: cacheTTL = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	response := negative(dns.RcodeNameError, 3600, 300)
+	now := time.Now()
+	entry, err := packCacheEntry(conf, response, cacheTTL(conf, response), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := unpackCacheEntry(entry, now.Add(100*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode %s, want NXDOMAIN", dns.RcodeToString[msg.Rcode])
+	}
+	if ttl := msg.Ns[0].Header().Ttl; ttl != 200 {
+		t.Errorf("SOA TTL after 100s = %d, want 300-100", ttl)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errCacheMiss is returned by Cache.Get for keys not in the cache.
+var errCacheMiss = errors.New("cache miss")
+
+// Cache stores packed cache entries, see packCacheEntry, until they expire.
+type Cache interface {
+	// Get returns the entry stored under key and how long it has left to
+	// live, or errCacheMiss.
+	Get(ctx context.Context, key string) ([]byte, time.Duration, error)
+	// Peek is Get without side effects: it is not counted in Stats and
+	// neither promotes nor copies the entry between tiers.
+	Peek(ctx context.Context, key string) ([]byte, time.Duration, error)
+	// Set stores entry under key for ttl.
+	Set(ctx context.Context, key string, entry []byte, ttl time.Duration) error
+	// Delete removes the entries stored under keys, if any.
+	Delete(ctx context.Context, keys ...string) error
+	// Purge removes the entries whose keys match any of patterns, in the
+	// glob syntax of the Redis SCAN command, and returns how many it removed.
+	Purge(ctx context.Context, patterns ...string) (int, error)
+	// Range calls fn for the entries whose keys match pattern, with how
+	// long they have left to live, until fn returns an error. Entries
+	// stored or removed meanwhile may or may not be seen.
+	Range(ctx context.Context, pattern string, fn func(key string, entry []byte, ttl time.Duration) error) error
+	Stats() CacheStats
+}
+
+// CacheStats counts the operations of a Cache since it was created.
+type CacheStats struct {
+	Backend string `json:"backend"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Sets    uint64 `json:"sets"`
+	Deletes uint64 `json:"deletes"`
+	Errors  uint64 `json:"errors"`
+	// Entries is the number of entries in the cache, or -1 if unknown.
+	Entries int `json:"entries"`
+}
+
+// cacheCounters implements the counting part of CacheStats.
+type cacheCounters struct {
+	hits, misses, sets, deletes, errors atomic.Uint64
+}
+
+// countGet counts the outcome of a Get and passes err through.
+func (c *cacheCounters) countGet(err error) error {
+	switch {
+	case err == nil:
+		c.hits.Add(1)
+	case errors.Is(err, errCacheMiss):
+		c.misses.Add(1)
+	default:
+		c.errors.Add(1)
+	}
+	return err
+}
+
+func (c *cacheCounters) count(counter *atomic.Uint64, err error) error {
+	if err != nil {
+		c.errors.Add(1)
+	} else {
+		counter.Add(1)
+	}
+	return err
+}
+
+func (c *cacheCounters) stats(backend string, entries int) CacheStats {
+	return CacheStats{
+		Backend: backend,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Sets:    c.sets.Load(),
+		Deletes: c.deletes.Load(),
+		Errors:  c.errors.Load(),
+		Entries: entries,
+	}
+}
+
+// Names accepted by the cache_backend option. "auto" picks the backend from
+// redis_url and memory_cache_size.
+var cacheBackends = []string{"auto", "none", "memory", "redis", "tiered"}
+
+// newCache returns the Cache selected by cache_backend. If Redis cannot be
+// reached, caching goes on without it.
+func newCache(conf *config) (Cache, error) {
+	backend := conf.CacheBackend
+	if backend == "auto" {
+		switch {
+		case conf.RedisURL != "" && conf.MemoryCacheSize > 0:
+			backend = "tiered"
+		case conf.RedisURL != "":
+			backend = "redis"
+		case conf.MemoryCacheSize > 0:
+			backend = "memory"
+		default:
+			backend = "none"
+		}
+	}
+
+	switch backend {
+	case "none":
+		log.Printf("No cache configured, running without cache")
+		return noopCache{}, nil
+	case "memory":
+		return newMemoryCache(int(conf.MemoryCacheSize)), nil
+	case "redis":
+		l2, err := newRedisCache(conf)
+		if err != nil {
+			log.Printf("Failed to connect to Redis at %s, caching disabled: %v", redactRedisURL(conf.RedisURL), err)
+			return noopCache{}, nil
+		}
+		return l2, nil
+	case "tiered":
+		l1 := newMemoryCache(int(conf.MemoryCacheSize))
+		l2, err := newRedisCache(conf)
+		if err != nil {
+			log.Printf("Failed to connect to Redis at %s, caching in memory only: %v", redactRedisURL(conf.RedisURL), err)
+			return l1, nil
+		}
+		c := newTieredCache(l1, l2)
+		c.invalidator = newCacheInvalidator(l2.client, l2.db, l1)
+		go c.invalidator.run(context.Background())
+		return c, nil
+	default:
+		return nil, &configError{fmt.Sprintf("unknown cache_backend %q", conf.CacheBackend)}
+	}
+}
+
+// noopCache caches nothing.
+type noopCache struct{}
+
+func (noopCache) Get(context.Context, string) ([]byte, time.Duration, error) {
+	return nil, 0, errCacheMiss
+}
+
+func (noopCache) Peek(context.Context, string) ([]byte, time.Duration, error) {
+	return nil, 0, errCacheMiss
+}
+
+func (noopCache) Set(context.Context, string, []byte, time.Duration) error { return nil }
+
+func (noopCache) Delete(context.Context, ...string) error { return nil }
+
+func (noopCache) Purge(context.Context, ...string) (int, error) { return 0, nil }
+
+func (noopCache) Range(context.Context, string, func(string, []byte, time.Duration) error) error {
+	return nil
+}
+
+func (noopCache) Stats() CacheStats { return CacheStats{Backend: "none"} }
+
+// invalidatingCache is implemented by caches whose entries other replicas may
+// hold copies of, which Invalidate has them drop.
+type invalidatingCache interface {
+	Invalidate(ctx context.Context, keys ...string) error
+}
+
+// tieredCache looks entries up in l1 first, then in l2, and stores them in
+// both. Entries found in l2 only are copied to l1 for the rest of their life.
+type tieredCache struct {
+	l1, l2 Cache
+	// invalidator, if set, has other replicas evict the entries changed in
+	// l2 from their l1.
+	invalidator *cacheInvalidator
+	cacheCounters
+}
+
+func newTieredCache(l1, l2 Cache) *tieredCache {
+	return &tieredCache{l1: l1, l2: l2}
+}
+
+func (c *tieredCache) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	if entry, ttl, err := c.l1.Get(ctx, key); err == nil {
+		c.hits.Add(1)
+		return entry, ttl, nil
+	}
+	entry, ttl, err := c.l2.Get(ctx, key)
+	if err == nil {
+		c.l1.Set(ctx, key, entry, ttl)
+	}
+	return entry, ttl, c.countGet(err)
+}
+
+func (c *tieredCache) Peek(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	if entry, ttl, err := c.l1.Peek(ctx, key); err == nil {
+		return entry, ttl, nil
+	}
+	return c.l2.Peek(ctx, key)
+}
+
+// Set does not tell other replicas: they cannot hold an entry this one missed,
+// except one replaced by a refresh, see Invalidate.
+func (c *tieredCache) Set(ctx context.Context, key string, entry []byte, ttl time.Duration) error {
+	c.l1.Set(ctx, key, entry, ttl)
+	return c.count(&c.sets, c.l2.Set(ctx, key, entry, ttl))
+}
+
+// Invalidate has other replicas evict the entries stored under keys from
+// their l1, so they pick up those just replaced in l2.
+func (c *tieredCache) Invalidate(ctx context.Context, keys ...string) error {
+	return c.invalidate(ctx, invalidation{Keys: keys})
+}
+
+func (c *tieredCache) Delete(ctx context.Context, keys ...string) error {
+	c.l1.Delete(ctx, keys...)
+	if err := c.count(&c.deletes, c.l2.Delete(ctx, keys...)); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, invalidation{Keys: keys})
+}
+
+func (c *tieredCache) Purge(ctx context.Context, patterns ...string) (int, error) {
+	c.l1.Purge(ctx, patterns...)
+	n, err := c.l2.Purge(ctx, patterns...)
+	if err := c.count(&c.deletes, err); err != nil {
+		return n, err
+	}
+	return n, c.invalidate(ctx, invalidation{Patterns: patterns})
+}
+
+func (c *tieredCache) invalidate(ctx context.Context, msg invalidation) error {
+	if c.invalidator == nil {
+		return nil
+	}
+	if err := c.invalidator.publish(ctx, msg); err != nil {
+		c.errors.Add(1)
+		return fmt.Errorf("notifying other replicas: %w", err)
+	}
+	return nil
+}
+
+// Range ranges over l2, which holds every entry of l1 but those it failed to
+// store.
+func (c *tieredCache) Range(ctx context.Context, pattern string, fn func(key string, entry []byte, ttl time.Duration) error) error {
+	return c.l2.Range(ctx, pattern, fn)
+}
+
+func (c *tieredCache) Stats() CacheStats {
+	return c.cacheCounters.stats("tiered", c.l1.Stats().Entries)
+}
+
+// globMatch reports whether key matches pattern, in the glob syntax of Redis
+// restricted to "*", "?" and "\" escapes, which is all cache key patterns use.
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(key); i >= 0; i-- {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// escapeGlob escapes the characters of s that have a meaning in patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]^\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
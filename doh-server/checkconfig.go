@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// checkConfig implements the check-config subcommand. It loads and validates
+// the configuration, including environment overrides, and returns the process
+// exit code.
+func checkConfig(args []string) int {
+	var configPath string
+
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.StringVar(&configPath, "conf", "", "configuration file path")
+	flags.Parse(args)
+
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Configuration is valid (%d listen address(es), %d upstream(s))\n", len(conf.Listen), len(conf.Upstream))
+	return 0
+}
@@ -1,25 +1,226 @@
 package main
 
 import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
 )
 
 type config struct {
-	TLSClientAuthCA     string   `toml:"tls_client_auth_ca"`
-	LocalAddr           string   `toml:"local_addr"`
-	Cert                string   `toml:"cert"`
-	Key                 string   `toml:"key"`
-	Path                string   `toml:"path"`
-	DebugHTTPHeaders    []string `toml:"debug_http_headers"`
-	Listen              []string `toml:"listen"`
-	Upstream            []string `toml:"upstream"`
-	Timeout             uint     `toml:"timeout"`
-	Tries               uint     `toml:"tries"`
-	Verbose             bool     `toml:"verbose"`
-	LogGuessedIP        bool     `toml:"log_guessed_client_ip"`
-	ECSAllowNonGlobalIP bool     `toml:"ecs_allow_non_global_ip"`
-	ECSUsePreciseIP     bool     `toml:"ecs_use_precise_ip"`
-	TLSClientAuth       bool     `toml:"tls_client_auth"`
+	TLSClientAuthCA           string        `toml:"tls_client_auth_ca"`
+	LocalAddr                 string        `toml:"local_addr"`
+	Cert                      string        `toml:"cert"`
+	Key                       string        `toml:"key"`
+	Path                      string        `toml:"path"`
+	UpstreamPolicy            string        `toml:"upstream_policy"`
+	CacheBackend              string        `toml:"cache_backend"`
+	RedisURL                  string        `toml:"redis_url"`
+	RedisSentinelMaster       string        `toml:"redis_sentinel_master"`
+	UpstreamTLSCA             string        `toml:"upstream_tls_ca"`
+	UpstreamTLSCert           string        `toml:"upstream_tls_cert"`
+	UpstreamTLSKey            string        `toml:"upstream_tls_key"`
+	AdminListen               string        `toml:"admin_listen"`
+	AdminToken                string        `toml:"admin_token"`
+	HealthCheckName           string        `toml:"health_check_name"`
+	HealthCheckType           string        `toml:"health_check_type"`
+	WarmupFile                string        `toml:"warmup_file"`
+	RedisSentinelAddrs        []string      `toml:"redis_sentinel_addrs"`
+	RedisClusterNodes         []string      `toml:"redis_cluster_nodes"`
+	DebugHTTPHeaders          []string      `toml:"debug_http_headers"`
+	Listen                    []string      `toml:"listen"`
+	DNSListen                 []string      `toml:"dns_listen"`
+	Upstream                  []string      `toml:"upstream"`
+	UpstreamTLSPins           []string      `toml:"upstream_tls_pins"`
+	Forward                   []forwardRule `toml:"forward"`
+	Timeout                   uint          `toml:"timeout"`
+	Tries                     uint          `toml:"tries"`
+	UpstreamRace              uint          `toml:"upstream_race"`
+	UpstreamPoolSize          uint          `toml:"upstream_pool_size"`
+	UpstreamIdleTimeout       uint          `toml:"upstream_idle_timeout"`
+	CacheMinTTL               uint          `toml:"cache_min_ttl"`
+	CacheMaxTTL               uint          `toml:"cache_max_ttl"`
+	CacheNegativeMaxTTL       uint          `toml:"cache_negative_max_ttl"`
+	CacheStaleMaxAge          uint          `toml:"cache_stale_max_age"`
+	PrefetchWindow            uint          `toml:"prefetch_window"`
+	PrefetchThreshold         uint          `toml:"prefetch_threshold"`
+	WarmupConcurrency         uint          `toml:"warmup_concurrency"`
+	WarmupTimeout             uint          `toml:"warmup_timeout"`
+	MemoryCacheSize           uint          `toml:"memory_cache_size"`
+	CacheStaleClientTimeoutMS uint          `toml:"cache_stale_client_timeout_ms"`
+	HealthCheckInterval       uint          `toml:"health_check_interval"`
+	HealthCheckFailures       uint          `toml:"health_check_failures"`
+	HealthCheckSuccesses      uint          `toml:"health_check_successes"`
+	Verbose                   bool          `toml:"verbose"`
+	LogGuessedIP              bool          `toml:"log_guessed_client_ip"`
+	ECSAllowNonGlobalIP       bool          `toml:"ecs_allow_non_global_ip"`
+	ECSUsePreciseIP           bool          `toml:"ecs_use_precise_ip"`
+	TLSClientAuth             bool          `toml:"tls_client_auth"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:         []string{"0.0.0.0:8053"},
+		Path:           "/dns-query",
+		Upstream:       []string{"udp:8.8.8.8:53"},
+		UpstreamPolicy: "random",
+		CacheBackend:   "auto",
+		Timeout:        10,
+		Tries:          3,
+
+		UpstreamPoolSize:    4,
+		UpstreamIdleTimeout: 30,
+		CacheMaxTTL:         86400,
+		CacheNegativeMaxTTL: 3600,
+
+		CacheStaleMaxAge:          86400,
+		CacheStaleClientTimeoutMS: 1800,
+		PrefetchThreshold:         2,
+		WarmupConcurrency:         8,
+		WarmupTimeout:             60,
+		Verbose:                   false,
+
+		HealthCheckName:      ".",
+		HealthCheckType:      "NS",
+		HealthCheckFailures:  3,
+		HealthCheckSuccesses: 2,
+	}
+}
+
+// loadConfig builds the effective configuration. Values are applied in this
+// order, later sources overriding earlier ones:
+//
+//  1. built-in defaults
+//  2. the TOML file at path, if path is not empty
+//  3. environment variables
+//
+// Unknown keys in the TOML file and options rejected by validateConfig are
+// reported as an error.
+func loadConfig(path string) (*config, error) {
+	conf := defaultConfig()
+
+	if path != "" {
+		metaData, err := toml.DecodeFile(path, conf)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := metaData.Undecoded(); len(undecoded) != 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, strconv.Quote(key.String()))
+			}
+			return nil, &configError{fmt.Sprintf("unknown option(s) in %s: %s", path, strings.Join(keys, ", "))}
+		}
+	}
+
+	if err := applyEnvOverrides(conf); err != nil {
+		return nil, err
+	}
+	if errs := validateConfig(conf); len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return conf, nil
+}
+
+// applyEnvOverrides overrides conf with the environment variables that are set.
+// When two variables map to the same option, the one listed later wins:
+//
+//	DOH_SERVER_LISTEN_PORT, DOH_SERVER_LISTEN -> listen
+//	DOH_DNS_LISTEN                            -> dns_listen
+//	DOH_HTTP_PREFIX                           -> path
+//	DOH_UPSTREAM_DNS, UPSTREAM_DNS_SERVER     -> upstream
+//	DOH_SERVER_TIMEOUT                        -> timeout
+//	DOH_SERVER_TRIES                          -> tries
+//	DOH_SERVER_VERBOSE                        -> verbose
+//	REDIS_URL                                 -> redis_url
+//	DOH_ADMIN_TOKEN                           -> admin_token
+func applyEnvOverrides(conf *config) error {
+	if port := os.Getenv("DOH_SERVER_LISTEN_PORT"); port != "" {
+		conf.Listen = []string{listenAddress(port)}
+	}
+	if listen := os.Getenv("DOH_SERVER_LISTEN"); listen != "" {
+		conf.Listen = nil
+		for _, addr := range strings.Split(listen, ",") {
+			conf.Listen = append(conf.Listen, listenAddress(strings.TrimSpace(addr)))
+		}
+	}
+
+	if listen := os.Getenv("DOH_DNS_LISTEN"); listen != "" {
+		conf.DNSListen = splitList(listen)
+	}
+
+	if prefix := os.Getenv("DOH_HTTP_PREFIX"); prefix != "" {
+		conf.Path = prefix
+	}
+
+	if upstream := os.Getenv("DOH_UPSTREAM_DNS"); upstream != "" {
+		conf.Upstream = splitList(upstream)
+	}
+	if upstream := os.Getenv("UPSTREAM_DNS_SERVER"); upstream != "" {
+		conf.Upstream = splitList(upstream)
+	}
+
+	if timeout := os.Getenv("DOH_SERVER_TIMEOUT"); timeout != "" {
+		t, err := strconv.ParseUint(timeout, 10, 0)
+		if err != nil {
+			return &configError{fmt.Sprintf("invalid DOH_SERVER_TIMEOUT %q", timeout)}
+		}
+		conf.Timeout = uint(t)
+	}
+
+	if tries := os.Getenv("DOH_SERVER_TRIES"); tries != "" {
+		t, err := strconv.ParseUint(tries, 10, 0)
+		if err != nil {
+			return &configError{fmt.Sprintf("invalid DOH_SERVER_TRIES %q", tries)}
+		}
+		conf.Tries = uint(t)
+	}
+
+	if verbose := os.Getenv("DOH_SERVER_VERBOSE"); verbose != "" {
+		v, err := strconv.ParseBool(verbose)
+		if err != nil {
+			return &configError{fmt.Sprintf("invalid DOH_SERVER_VERBOSE %q", verbose)}
+		}
+		conf.Verbose = v
+	}
+
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		conf.RedisURL = redisURL
+	}
+
+	if token := os.Getenv("DOH_ADMIN_TOKEN"); token != "" {
+		conf.AdminToken = token
+	}
+
+	return nil
+}
+
+// listenAddress turns a bare port into a wildcard listen address.
+func listenAddress(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return "0.0.0.0:" + addr
+	}
+	return addr
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 var rxUpstreamWithTypePrefix = regexp.MustCompile("^[a-z-]+(:)")
@@ -33,6 +234,208 @@ func addressAndType(us string) (string, string) {
 	return us[p[2]+1:], us[:p[2]]
 }
 
+// validateConfig checks conf without contacting any upstream and returns one
+// error per problem found.
+func validateConfig(conf *config) []error {
+	var errs []error
+	addErr := func(format string, a ...any) {
+		errs = append(errs, &configError{fmt.Sprintf(format, a...)})
+	}
+
+	if len(conf.Listen) == 0 {
+		addErr("listen: no listen address configured")
+	}
+	for _, addr := range conf.Listen {
+		if err := validateHostPort(addr); err != nil {
+			addErr("listen %q: %v", addr, err)
+		}
+	}
+	for _, addr := range conf.DNSListen {
+		if _, _, err := parseDNSListen(addr); err != nil {
+			addErr("dns_listen %q: %v", addr, err)
+		}
+	}
+	if !strings.HasPrefix(conf.Path, "/") {
+		addErr("path %q: must start with \"/\"", conf.Path)
+	}
+
+	checkUpstreams := func(option string, upstreams []string, policy string) {
+		if len(upstreams) == 0 {
+			addErr("%s: no upstream DNS server configured", option)
+		}
+		for _, us := range upstreams {
+			u, err := parseUpstream(us)
+			if err != nil {
+				addErr("%s %q: %v", option, us, err)
+				continue
+			}
+			if u.usesTLS() {
+				if _, err := upstreamTLSConfig(conf, u); err != nil {
+					addErr("%s %q: %v", option, us, err)
+				}
+			}
+		}
+		if _, ok := selectionPolicies[policy]; !ok {
+			addErr("%s_policy %q: expected one of \"random\", \"failover\", \"round_robin\" or \"ewma\"", option, policy)
+		}
+	}
+	checkUpstreams("upstream", conf.Upstream, conf.UpstreamPolicy)
+
+	suffixes := make(map[string]bool)
+	for i, rule := range conf.Forward {
+		prefix := fmt.Sprintf("forward[%d].", i)
+		if len(rule.Suffix) == 0 {
+			addErr("%ssuffix: no domain suffix configured", prefix)
+		}
+		for _, suffix := range rule.Suffix {
+			name := dns.CanonicalName(suffix)
+			_, valid := dns.IsDomainName(name)
+			switch {
+			case suffix == "" || name == ".":
+				addErr("%ssuffix %q: matches every name, use the upstream option instead", prefix, suffix)
+			case !valid:
+				addErr("%ssuffix %q: not a valid domain name", prefix, suffix)
+			case suffixes[name]:
+				addErr("%ssuffix %q: used by more than one forward rule", prefix, suffix)
+			}
+			suffixes[name] = true
+		}
+		checkUpstreams(prefix+"upstream", rule.Upstream, cmp.Or(rule.UpstreamPolicy, conf.UpstreamPolicy))
+	}
+
+	if conf.Timeout == 0 {
+		addErr("timeout: must be greater than 0")
+	}
+	if conf.Tries == 0 {
+		addErr("tries: must be greater than 0")
+	}
+	if conf.UpstreamPoolSize > 0 && conf.UpstreamIdleTimeout == 0 {
+		addErr("upstream_idle_timeout: must be greater than 0 when upstream_pool_size is set")
+	}
+	if conf.CacheMaxTTL == 0 || conf.CacheMaxTTL > math.MaxInt32 {
+		addErr("cache_max_ttl: must be between 1 and %d", math.MaxInt32)
+	}
+	if conf.RedisURL != "" {
+		if _, err := redisOptions(conf); err != nil {
+			addErr("%v", err)
+		}
+		for _, addr := range append(conf.RedisSentinelAddrs, conf.RedisClusterNodes...) {
+			if err := validateHostPort(addr); err != nil {
+				addErr("redis address %q: %v", addr, err)
+			}
+		}
+	}
+	switch conf.CacheBackend {
+	case "auto", "none":
+	case "memory", "redis", "tiered":
+		if conf.CacheBackend != "memory" && conf.RedisURL == "" {
+			addErr("cache_backend %q: redis_url is not set", conf.CacheBackend)
+		}
+		if conf.CacheBackend != "redis" && conf.MemoryCacheSize == 0 {
+			addErr("cache_backend %q: memory_cache_size is not set", conf.CacheBackend)
+		}
+	default:
+		addErr("cache_backend %q: expected one of %q", conf.CacheBackend, cacheBackends)
+	}
+	if conf.CacheStaleMaxAge > math.MaxInt32 {
+		addErr("cache_stale_max_age: must not be greater than %d", math.MaxInt32)
+	}
+	if conf.PrefetchWindow >= 100 {
+		addErr("prefetch_window: must be a percentage below 100")
+	}
+	// The warm-up file itself is only read at startup, see warmCache.
+	if conf.WarmupFile != "" {
+		if conf.WarmupConcurrency == 0 {
+			addErr("warmup_concurrency: must be greater than 0")
+		}
+		if conf.WarmupTimeout == 0 {
+			addErr("warmup_timeout: must be greater than 0")
+		}
+	}
+	if conf.CacheMinTTL > conf.CacheMaxTTL {
+		addErr("cache_min_ttl: must not be greater than cache_max_ttl")
+	}
+	if conf.HealthCheckInterval > 0 {
+		if _, ok := dns.IsDomainName(conf.HealthCheckName); !ok {
+			addErr("health_check_name %q: invalid domain name", conf.HealthCheckName)
+		}
+		if _, ok := dns.StringToType[conf.HealthCheckType]; !ok {
+			addErr("health_check_type %q: unknown record type", conf.HealthCheckType)
+		}
+		if conf.HealthCheckSuccesses == 0 {
+			addErr("health_check_successes: must be greater than 0")
+		}
+	}
+	if conf.AdminListen != "" {
+		if err := validateHostPort(conf.AdminListen); err != nil {
+			addErr("admin_listen %q: %v", conf.AdminListen, err)
+		}
+	}
+	if conf.LocalAddr != "" {
+		if _, err := net.ResolveUDPAddr("udp", conf.LocalAddr); err != nil {
+			addErr("local_addr %q: %v", conf.LocalAddr, err)
+		}
+	}
+
+	if conf.Cert != "" || conf.Key != "" {
+		if conf.Cert == "" || conf.Key == "" {
+			addErr("cert and key must be set together")
+		} else if err := validateKeyPair(conf.Cert, conf.Key); err != nil {
+			addErr("cert %q, key %q: %v", conf.Cert, conf.Key, err)
+		}
+	}
+	if conf.TLSClientAuth {
+		if conf.Cert == "" {
+			addErr("tls_client_auth: requires cert and key")
+		}
+		if conf.TLSClientAuthCA == "" {
+			addErr("tls_client_auth: requires tls_client_auth_ca")
+		} else if err := validateCAFile(conf.TLSClientAuthCA); err != nil {
+			addErr("tls_client_auth_ca %q: %v", conf.TLSClientAuthCA, err)
+		}
+	}
+
+	return errs
+}
+
+func validateHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(host, " /") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validateKeyPair(certFile, keyFile string) error {
+	if _, err := os.ReadFile(certFile); err != nil {
+		return err
+	}
+	if _, err := os.ReadFile(keyFile); err != nil {
+		return err
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("certificate and key do not form a valid pair: %w", err)
+	}
+	return nil
+}
+
+func validateCAFile(caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM encoded certificate found")
+	}
+	return nil
+}
+
 type configError struct {
 	err string
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "doh-server.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// 127.0.0.1 and its key to a temporary directory and returns both file names.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	path := writeConfigFile(t, `
+listen = ["127.0.0.1:8443"]
+cert = "`+certFile+`"
+key = "`+keyFile+`"
+upstream = ["udp:127.0.0.1:53", "tcp-tls:1.1.1.1:853"]
+timeout = 5
+debug_http_headers = ["CF-Ray"]
+ecs_use_precise_ip = true
+`)
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Cert != certFile || conf.Key != keyFile {
+		t.Errorf("cert/key not loaded: %q %q", conf.Cert, conf.Key)
+	}
+	if !reflect.DeepEqual(conf.Listen, []string{"127.0.0.1:8443"}) {
+		t.Errorf("listen = %v", conf.Listen)
+	}
+	if !reflect.DeepEqual(conf.DebugHTTPHeaders, []string{"CF-Ray"}) {
+		t.Errorf("debug_http_headers = %v", conf.DebugHTTPHeaders)
+	}
+	if conf.Timeout != 5 || !conf.ECSUsePreciseIP {
+		t.Errorf("timeout = %d, ecs_use_precise_ip = %v", conf.Timeout, conf.ECSUsePreciseIP)
+	}
+	// Keys absent from the file keep their defaults.
+	if conf.Tries != 3 || conf.Path != "/dns-query" {
+		t.Errorf("defaults not kept: tries = %d, path = %q", conf.Tries, conf.Path)
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+listen = ["127.0.0.1:8443"]
+upstream = ["udp:127.0.0.1:53"]
+tries = 5
+`)
+	t.Setenv("DOH_SERVER_LISTEN_PORT", "9053")
+	t.Setenv("DOH_UPSTREAM_DNS", "udp:9.9.9.9:53")
+	t.Setenv("UPSTREAM_DNS_SERVER", "tcp:1.1.1.1:53, udp:1.0.0.1:53")
+	t.Setenv("DOH_SERVER_TRIES", "2")
+	t.Setenv("REDIS_URL", "redis:6379")
+	t.Setenv("DOH_ADMIN_TOKEN", "s3cret")
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Listen, []string{"0.0.0.0:9053"}) {
+		t.Errorf("listen = %v", conf.Listen)
+	}
+	if !reflect.DeepEqual(conf.Upstream, []string{"tcp:1.1.1.1:53", "udp:1.0.0.1:53"}) {
+		t.Errorf("upstream = %v", conf.Upstream)
+	}
+	if conf.Tries != 2 {
+		t.Errorf("tries = %d", conf.Tries)
+	}
+	if conf.RedisURL != "redis:6379" {
+		t.Errorf("redis_url = %q", conf.RedisURL)
+	}
+	if conf.AdminToken != "s3cret" {
+		t.Errorf("admin_token = %q", conf.AdminToken)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, `
+upstream = ["udp:127.0.0.1:53"]
+upstreams = ["udp:127.0.0.2:53"]
+`)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("expected error for unknown key")
+	}
+
+	t.Setenv("DOH_SERVER_TIMEOUT", "ten")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("expected error for invalid DOH_SERVER_TIMEOUT")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	t.Parallel()
+
+	if errs := validateConfig(defaultConfig()); len(errs) != 0 {
+		t.Errorf("default configuration rejected: %v", errs)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*config)
+	}{
+		{"upstream without prefix", func(c *config) { c.Upstream = []string{"8.8.8.8:53"} }},
+		{"upstream unknown protocol", func(c *config) { c.Upstream = []string{"sctp:8.8.8.8:53"} }},
+		{"upstream without port", func(c *config) { c.Upstream = []string{"udp:8.8.8.8"} }},
+		{"no upstream", func(c *config) { c.Upstream = nil }},
+		{"invalid listen", func(c *config) { c.Listen = []string{"0.0.0.0:http"} }},
+		{"zero tries", func(c *config) { c.Tries = 0 }},
+		{"zero timeout", func(c *config) { c.Timeout = 0 }},
+		{"cert without key", func(c *config) { c.Cert = "server.crt" }},
+		{"missing cert files", func(c *config) { c.Cert, c.Key = "/nonexistent.crt", "/nonexistent.key" }},
+		{"client auth without CA", func(c *config) { c.TLSClientAuth = true }},
+		{"unknown cache backend", func(c *config) { c.CacheBackend = "memcached" }},
+		{"redis cache without redis_url", func(c *config) { c.CacheBackend = "redis" }},
+		{"memory cache without size", func(c *config) { c.CacheBackend = "memory" }},
+		{"cache_min_ttl above cache_max_ttl", func(c *config) { c.CacheMinTTL = c.CacheMaxTTL + 1 }},
+		{"mismatched cert and key", func(c *config) {
+			certFile, _ := writeTestCertificate(t)
+			_, keyFile := writeTestCertificate(t)
+			c.Cert, c.Key = certFile, keyFile
+		}},
+	} {
+		conf := defaultConfig()
+		tc.modify(conf)
+		if errs := validateConfig(conf); len(errs) == 0 {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+
+	certFile, keyFile := writeTestCertificate(t)
+	conf := defaultConfig()
+	conf.Cert, conf.Key = certFile, keyFile
+	conf.TLSClientAuth = true
+	conf.TLSClientAuthCA = certFile
+	if errs := validateConfig(conf); len(errs) != 0 {
+		t.Errorf("valid TLS configuration rejected: %v", errs)
+	}
+	conf.TLSClientAuthCA = keyFile
+	if errs := validateConfig(conf); len(errs) != 1 || !strings.Contains(errs[0].Error(), "tls_client_auth_ca") {
+		t.Errorf("expected a tls_client_auth_ca error, got %v", errs)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errConnClosed is returned for queries on a pooled connection that was
+// closed, by either side, before the answer arrived.
+var errConnClosed = errors.New("upstream connection closed")
+
+// connPool keeps persistent TCP or DNS-over-TLS connections to one upstream
+// and pipelines concurrent queries over them (RFC 7766 section 6.2.1.1),
+// matching answers to queries by message ID.
+type connPool struct {
+	addr        string
+	client      *dns.Client
+	size        int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	dialed  *sync.Cond
+	conns   []*pooledConn
+	dialing int
+	closed  bool
+}
+
+type pooledConn struct {
+	pool *connPool
+	conn *dns.Conn
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	pending     map[uint16]chan *dns.Msg
+	err         error
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+}
+
+// newConnPool returns a pool of up to size connections dialed with client,
+// which are closed after being idle for idleTimeout, or for the shorter
+// timeout the upstream asks for with edns-tcp-keepalive (RFC 7828).
+func newConnPool(addr string, client *dns.Client, size int, idleTimeout time.Duration) *connPool {
+	p := &connPool{
+		addr:        addr,
+		client:      client,
+		size:        size,
+		idleTimeout: idleTimeout,
+	}
+	p.dialed = sync.NewCond(&p.mu)
+	return p
+}
+
+// exchange sends msg over a pooled connection. If a reused connection turns
+// out to be closed by the upstream, the query is retried once on a new one.
+func (p *connPool) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.client.Timeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := pc.exchange(ctx, msg)
+		if errors.Is(err, errConnClosed) && reused && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		return reply, err
+	}
+}
+
+// get returns the least busy connection. A new connection is dialed while the
+// pool is not full and every connection has queries in flight. When the pool
+// is full of connections still being dialed, get waits for one of them.
+func (p *connPool) get(ctx context.Context) (*pooledConn, bool, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, errConnClosed
+		}
+		var best *pooledConn
+		bestLoad := 0
+		for _, pc := range p.conns {
+			if load := pc.load(); best == nil || load < bestLoad {
+				best, bestLoad = pc, load
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.size
+		if best != nil && (bestLoad == 0 || full) {
+			p.mu.Unlock()
+			return best, true, nil
+		}
+		if !full {
+			break
+		}
+		p.dialed.Wait()
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	conn, err := p.client.DialContext(ctx, p.addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	defer p.dialed.Broadcast()
+	if err != nil {
+		return nil, false, err
+	}
+	pc := &pooledConn{
+		pool:        p,
+		conn:        conn,
+		pending:     make(map[uint16]chan *dns.Msg),
+		idleTimeout: p.idleTimeout,
+	}
+	if p.closed {
+		conn.Close()
+		return nil, false, errConnClosed
+	}
+	p.conns = append(p.conns, pc)
+	go pc.readLoop()
+	return pc, false, nil
+}
+
+func (p *connPool) remove(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// close closes every connection, failing the queries still in flight.
+func (p *connPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	p.dialed.Broadcast()
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.fail(errConnClosed)
+	}
+}
+
+func (pc *pooledConn) load() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+func (pc *pooledConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	query := msg.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		// Ask the upstream how long it keeps idle connections open.
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	answer := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil, pc.err
+	}
+	query.Id = dns.Id()
+	for pc.pending[query.Id] != nil {
+		query.Id = dns.Id()
+	}
+	pc.pending[query.Id] = answer
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+	}
+	pc.mu.Unlock()
+
+	pc.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetWriteDeadline(deadline)
+	}
+	err := pc.conn.WriteMsg(query)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.fail(fmt.Errorf("%w: %v", errConnClosed, err))
+		return nil, pc.closedErr()
+	}
+
+	select {
+	case reply, ok := <-answer:
+		if !ok {
+			return nil, pc.closedErr()
+		}
+		reply.Id = msg.Id
+		// The keepalive timeout, read by readLoop, applies to this
+		// connection only and must not reach clients (RFC 7828 section
+		// 3.2.2).
+		if opt := reply.IsEdns0(); opt != nil {
+			opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+				return o.Option() == dns.EDNS0TCPKEEPALIVE
+			})
+		}
+		return reply, nil
+	case <-ctx.Done():
+		pc.mu.Lock()
+		delete(pc.pending, query.Id)
+		pc.startIdleTimer()
+		pc.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (pc *pooledConn) closedErr() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
+
+// readLoop dispatches answers to the queries waiting for them until the
+// connection fails or is closed.
+func (pc *pooledConn) readLoop() {
+	for {
+		reply, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.fail(fmt.Errorf("%w: %v", errConnClosed, err))
+			return
+		}
+
+		pc.mu.Lock()
+		if opt := reply.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok && keepalive.Timeout > 0 {
+					pc.idleTimeout = min(pc.pool.idleTimeout, time.Duration(keepalive.Timeout)*100*time.Millisecond)
+				}
+			}
+		}
+		answer := pc.pending[reply.Id]
+		delete(pc.pending, reply.Id)
+		pc.startIdleTimer()
+		pc.mu.Unlock()
+
+		if answer != nil {
+			answer <- reply
+		}
+	}
+}
+
+// startIdleTimer closes the connection once it has been idle for the idle
+// timeout. pc.mu must be held.
+func (pc *pooledConn) startIdleTimer() {
+	if len(pc.pending) != 0 || pc.err != nil {
+		return
+	}
+	if pc.idleTimer == nil {
+		pc.idleTimer = time.AfterFunc(pc.idleTimeout, pc.closeIfIdle)
+	} else {
+		pc.idleTimer.Reset(pc.idleTimeout)
+	}
+}
+
+func (pc *pooledConn) closeIfIdle() {
+	if pc.load() == 0 {
+		pc.fail(fmt.Errorf("%w: idle", errConnClosed))
+	}
+}
+
+// fail closes the connection, removes it from the pool and fails every query
+// still waiting for an answer with err.
+func (pc *pooledConn) fail(err error) {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return
+	}
+	pc.err = err
+	pending := pc.pending
+	pc.pending = nil
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+	}
+	pc.mu.Unlock()
+
+	pc.pool.remove(pc)
+	pc.conn.Close()
+	for _, answer := range pending {
+		close(answer)
+	}
+}
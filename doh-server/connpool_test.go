@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startTestTCPServer(t *testing.T, handler dns.HandlerFunc) (string, *countingListener, *dns.Server) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener}
+	server := &dns.Server{Listener: counting, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String(), counting, server
+}
+
+func TestConnPoolPipelining(t *testing.T) {
+	t.Parallel()
+	addr, listener, _ := startTestTCPServer(t, answerA)
+	pool := newConnPool(addr, &dns.Client{Net: "tcp", Timeout: 2 * time.Second}, 2, time.Minute)
+	defer pool.close()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.Id = uint16(i)
+			reply, err := pool.exchange(t.Context(), msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.Id != msg.Id || len(reply.Answer) != 1 {
+				t.Errorf("unexpected reply %v", reply)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := listener.accepted.Load(); n == 0 || n > 2 {
+		t.Errorf("%d connections for 50 queries, want at most 2", n)
+	}
+}
+
+func TestConnPoolReconnect(t *testing.T) {
+	t.Parallel()
+	var keepalive atomic.Bool
+	addr, listener, _ := startTestTCPServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if opt := r.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if _, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+					keepalive.Store(true)
+				}
+			}
+			// Ask the client to close the connection after 100ms.
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 1})
+		}
+		w.WriteMsg(m)
+	})
+	pool := newConnPool(addr, &dns.Client{Net: "tcp", Timeout: 2 * time.Second}, 1, time.Minute)
+	defer pool.close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	for range 2 {
+		reply, err := pool.exchange(t.Context(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := reply.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+			t.Errorf("reply carries options %v, want the OPT record without edns-tcp-keepalive", opt)
+		}
+	}
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("%d connections for 2 sequential queries, want 1", n)
+	}
+	if !keepalive.Load() {
+		t.Error("query did not carry the edns-tcp-keepalive option")
+	}
+	if len(msg.IsEdns0().Option) != 0 {
+		t.Error("exchange modified the query of the caller")
+	}
+
+	// The connection is closed after the keepalive timeout of the upstream.
+	time.Sleep(300 * time.Millisecond)
+	if _, err := pool.exchange(t.Context(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if n := listener.accepted.Load(); n != 2 {
+		t.Errorf("%d connections after the idle timeout, want 2", n)
+	}
+}
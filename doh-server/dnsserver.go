@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	jsondns "github.com/stenstromen/dns-over-https/json-dns"
+)
+
+// parseDNSListen splits a dns_listen address into the networks to listen on
+// and host:port. "udp:" or "tcp:" selects one network, no prefix both.
+func parseDNSListen(addr string) ([]string, string, error) {
+	nets := []string{"udp", "tcp"}
+	if network, hostport, ok := strings.Cut(addr, ":"); ok && (network == "udp" || network == "tcp") {
+		nets, addr = []string{network}, hostport
+	}
+	if err := validateHostPort(addr); err != nil {
+		return nil, "", err
+	}
+	return nets, addr, nil
+}
+
+// dnsServers returns the plain DNS servers of dns_listen.
+func (s *Server) dnsServers(conf *config) []*dns.Server {
+	var servers []*dns.Server
+	for _, listen := range conf.DNSListen {
+		nets, addr, _ := parseDNSListen(listen)
+		for _, network := range nets {
+			servers = append(servers, &dns.Server{
+				Addr:    addr,
+				Net:     network,
+				Handler: dns.HandlerFunc(s.serveDNS),
+			})
+		}
+	}
+	return servers
+}
+
+// serveDNS answers plain DNS queries through the pipeline of DoH requests.
+func (s *Server) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	state := s.state.Load()
+	ctx := context.WithValue(context.Background(), stateContextKey{}, state)
+	conf := state.conf
+
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		reply := new(dns.Msg)
+		reply.SetRcode(r, dns.RcodeFormatError)
+		if r.Opcode != dns.OpcodeQuery {
+			reply.Rcode = dns.RcodeNotImplemented
+		}
+		w.WriteMsg(reply)
+		return
+	}
+
+	var clientIP net.IP
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		clientIP = net.ParseIP(host)
+	}
+	if conf.Verbose {
+		logQuestion(w.RemoteAddr().String(), &r.Question[0])
+	}
+	if !conf.ECSAllowNonGlobalIP && !jsondns.IsGlobalIP(clientIP) {
+		clientIP = nil
+	}
+
+	msg := r.Copy()
+	msg.Id = dns.Id()
+	req := &DNSRequest{
+		request:       msg,
+		transactionID: r.Id,
+		isTailored:    addClientSubnet(conf, msg, clientIP),
+	}
+	req = s.patchRootRD(req)
+
+	if err := s.doDNSQuery(ctx, req); err != nil {
+		log.Printf("DNS query failure for %s: %v", w.RemoteAddr(), err)
+		reply := new(dns.Msg)
+		reply.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(reply)
+		return
+	}
+
+	response := req.response
+	response.Id = req.transactionID
+	// Clients that did not use EDNS must not get an OPT record (RFC 6891
+	// section 7), nor an ECS option they did not send (RFC 7871 section 7.2).
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+		if opt := response.IsEdns0(); opt != nil && req.isTailored {
+			opt.Option = slices.DeleteFunc(slices.Clone(opt.Option), func(o dns.EDNS0) bool {
+				return o.Option() == dns.EDNS0SUBNET
+			})
+		}
+	} else {
+		response.Extra = slices.DeleteFunc(response.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	}
+	if tcp {
+		size = dns.MaxMsgSize
+	}
+	response.Truncate(size)
+	if err := w.WriteMsg(response); err != nil {
+		log.Printf("failed to write to client: %v\n", err)
+	}
+}
+
+// listenDNS serves plain DNS on server until it fails.
+func listenDNS(server *dns.Server) error {
+	log.Printf("DNS listener on %s/%s", server.Addr, server.Net)
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("DNS listener on %s/%s: %w", server.Addr, server.Net, err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNS(t *testing.T) {
+	t.Parallel()
+	var queries, withSubnet atomic.Int32
+	upstream := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{testResponse(60, 60).Answer[0]}
+		m.Answer[0].Header().Name = r.Question[0].Name
+		// Echo the OPT record, ECS included, like resolvers do.
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0SUBNET {
+					withSubnet.Add(1)
+				}
+			}
+			m.Extra = append(m.Extra, opt)
+		}
+		w.WriteMsg(m)
+	})
+	server := &Server{cache: newMemoryCache(10)}
+	state := newTestState(t, "random", "udp:"+upstream)
+	state.conf.ECSAllowNonGlobalIP = true
+	server.state.Store(state)
+	addr := startTestDNSServer(t, server.serveDNS)
+
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		resp, _, err := client.Exchange(msg, addr)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if resp.Id != msg.Id || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("%s: unexpected response %v", network, resp)
+		}
+		if resp.IsEdns0() != nil {
+			t.Errorf("%s: OPT record in the response to a query without EDNS", network)
+		}
+
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		resp, _, err = client.Exchange(msg, addr)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		opt := resp.IsEdns0()
+		if opt == nil {
+			t.Fatalf("%s: no OPT record in the response to an EDNS query", network)
+		}
+		if len(opt.Option) != 0 {
+			t.Errorf("%s: options %v the client did not send", network, opt.Option)
+		}
+	}
+	// Both networks share the cache, and upstream queries carry the client
+	// subnet.
+	if n := queries.Load(); n != 1 || withSubnet.Load() != 1 {
+		t.Errorf("%d upstream queries, %d with ECS, want 1 with ECS", n, withSubnet.Load())
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Question = append(msg.Question, msg.Question[0])
+	if resp, err := dns.Exchange(msg, addr); err != nil || resp.Rcode != dns.RcodeFormatError {
+		t.Errorf("two questions: got %v, %v, want FORMERR", resp, err)
+	}
+}
+
+func TestParseDNSListen(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		addr string
+		nets []string
+		ok   bool
+	}{
+		{"0.0.0.0:53", []string{"udp", "tcp"}, true},
+		{"udp:[::1]:5353", []string{"udp"}, true},
+		{"tcp:127.0.0.1:53", []string{"tcp"}, true},
+		{"quic:127.0.0.1:853", nil, false},
+		{"udp:", nil, false},
+	}
+	for _, tt := range tests {
+		nets, _, err := parseDNSListen(tt.addr)
+		if (err == nil) != tt.ok || len(nets) != len(tt.nets) || (tt.ok && nets[0] != tt.nets[0]) {
+			t.Errorf("parseDNSListen(%q) = %v, %v", tt.addr, nets, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Error codes of RFC 9250 section 4.3.
+const (
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+// doqConn keeps the long-lived QUIC connection to a DNS-over-QUIC (RFC 9250)
+// upstream. Every query is sent on a new stream of that connection.
+type doqConn struct {
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	timeout    time.Duration
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func newDoQConn(addr string, tlsConfig *tls.Config, timeout time.Duration) *doqConn {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	return &doqConn{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: timeout,
+			MaxIdleTimeout:       time.Minute,
+		},
+		timeout: timeout,
+	}
+}
+
+// get returns the current connection, dialing a new one if there is none or
+// the previous one was closed.
+func (c *doqConn) get(ctx context.Context) (*quic.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		return c.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, c.addr, c.tlsConfig, c.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// drop forgets conn so that the next query dials a new connection.
+func (c *doqConn) drop(conn *quic.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.CloseWithError(doqNoError, "")
+}
+
+func (c *doqConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.CloseWithError(doqNoError, "")
+		c.conn = nil
+	}
+}
+
+// exchange sends msg on a new stream. If the connection turns out to be
+// closed by the upstream, the query is retried once on a new connection.
+func (c *doqConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	// RFC 9250 section 4.2.1: the DNS Message ID must be 0.
+	query := msg.Copy()
+	query.Id = 0
+	queryBinary, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := c.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := exchangeDoQStream(ctx, conn, queryBinary)
+		if err != nil {
+			if conn.Context().Err() != nil && ctx.Err() == nil && attempt == 0 {
+				c.drop(conn)
+				continue
+			}
+			return nil, err
+		}
+		reply.Id = msg.Id
+		return reply, nil
+	}
+}
+
+func exchangeDoQStream(ctx context.Context, conn *quic.Conn, queryBinary []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	// Every message is prefixed with its length, and the client closes its
+	// direction of the stream after the query (RFC 9250 section 4.2).
+	buf := make([]byte, 2+len(queryBinary))
+	binary.BigEndian.PutUint16(buf, uint16(len(queryBinary)))
+	copy(buf[2:], queryBinary)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	respBinary := make([]byte, length)
+	if _, err := io.ReadFull(stream, respBinary); err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(respBinary); err != nil {
+		return nil, fmt.Errorf("invalid DoQ response: %w", err)
+	}
+	return reply, nil
+}
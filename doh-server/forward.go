@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// forwardRule sends queries for names under any of its suffixes to its own
+// upstreams, instead of those of the upstream option.
+type forwardRule struct {
+	Suffix         []string `toml:"suffix"`
+	Upstream       []string `toml:"upstream"`
+	UpstreamPolicy string   `toml:"upstream_policy"`
+}
+
+// upstreamGroup is a set of upstreams the tries of a query are spread over by
+// one selection policy.
+type upstreamGroup struct {
+	upstreams []*upstream
+	policy    selectionPolicy
+}
+
+// newUpstreamGroup builds a group of the upstreams names. Upstreams already
+// used by another group of st are shared with it, so that each is health
+// checked and pooled once.
+func (st *serverState) newUpstreamGroup(names []string, policyName string, registry *healthRegistry) (*upstreamGroup, error) {
+	newPolicy, ok := selectionPolicies[policyName]
+	if !ok {
+		return nil, &configError{fmt.Sprintf("unknown upstream_policy %q", policyName)}
+	}
+	group := &upstreamGroup{
+		upstreams: make([]*upstream, 0, len(names)),
+		policy:    newPolicy(),
+	}
+	for _, name := range names {
+		u := st.upstreamNamed(name)
+		if u == nil {
+			var err error
+			u, err = parseUpstream(name)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %q: %w", name, err)
+			}
+			u.health = registry.get(name)
+			st.upstreams = append(st.upstreams, u)
+		}
+		group.upstreams = append(group.upstreams, u)
+	}
+	return group, nil
+}
+
+func (st *serverState) upstreamNamed(name string) *upstream {
+	for _, u := range st.upstreams {
+		if u.name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// groupFor returns the upstreams for queries about name: those of the forward
+// rule with the longest suffix matching name, or the default ones.
+func (st *serverState) groupFor(name string) *upstreamGroup {
+	if len(st.forward) == 0 {
+		return st.defaultGroup
+	}
+	name = dns.CanonicalName(name)
+	for _, i := range dns.Split(name) {
+		if group, ok := st.forward[name[i:]]; ok {
+			return group
+		}
+	}
+	return st.defaultGroup
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestForwardRules(t *testing.T) {
+	t.Parallel()
+	conf, err := loadConfig(writeConfigFile(t, `
+upstream = ["udp:192.0.2.1:53"]
+upstream_policy = "round_robin"
+
+[[forward]]
+suffix = ["corp.example.", "10.in-addr.arpa"]
+upstream = ["udp:10.0.0.53:53", "udp:10.0.1.53:53"]
+upstream_policy = "failover"
+
+[[forward]]
+suffix = ["lab.Corp.Example."]
+upstream = ["udp:10.0.0.53:53"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := newServerState(conf, &healthRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp, lab := state.forward["corp.example."], state.forward["lab.corp.example."]
+	if corp == nil || lab == nil || state.forward["10.in-addr.arpa."] != corp {
+		t.Fatalf("unexpected forward rules %v", state.forward)
+	}
+
+	for name, want := range map[string]*upstreamGroup{
+		"corp.example.":           corp,
+		"WWW.corp.example.":       corp,
+		"1.2.3.10.in-addr.arpa.":  corp,
+		"host.lab.corp.example.":  lab,
+		"lab.corp.example.":       lab,
+		"notcorp.example.":        state.defaultGroup,
+		"example.":                state.defaultGroup,
+		"1.2.3.192.in-addr.arpa.": state.defaultGroup,
+		".":                       state.defaultGroup,
+	} {
+		if got := state.groupFor(name); got != want {
+			t.Errorf("groupFor(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if len(state.upstreams) != 3 {
+		t.Errorf("%d upstreams, want 3 since 10.0.0.53 is shared", len(state.upstreams))
+	}
+	if corp.upstreams[0] != lab.upstreams[0] {
+		t.Error("upstream used by two rules is not shared")
+	}
+	if _, ok := corp.policy.(failoverPolicy); !ok {
+		t.Errorf("corp rule uses %T, want failoverPolicy", corp.policy)
+	}
+	if _, ok := lab.policy.(*roundRobinPolicy); !ok {
+		t.Errorf("lab rule uses %T, want the global round_robin policy", lab.policy)
+	}
+}
+
+func TestForwardRulesInvalid(t *testing.T) {
+	t.Parallel()
+	for _, rules := range [][]forwardRule{
+		{{Upstream: []string{"udp:10.0.0.53:53"}}},
+		{{Suffix: []string{"corp.example."}}},
+		{{Suffix: []string{"."}, Upstream: []string{"udp:10.0.0.53:53"}}},
+		{{Suffix: []string{"corp..example."}, Upstream: []string{"udp:10.0.0.53:53"}}},
+		{{Suffix: []string{"corp.example."}, Upstream: []string{"10.0.0.53:53"}}},
+		{{Suffix: []string{"corp.example."}, Upstream: []string{"udp:10.0.0.53:53"}, UpstreamPolicy: "fastest"}},
+		{
+			{Suffix: []string{"corp.example."}, Upstream: []string{"udp:10.0.0.53:53"}},
+			{Suffix: []string{"CORP.example"}, Upstream: []string{"udp:10.0.1.53:53"}},
+		},
+	} {
+		conf := defaultConfig()
+		conf.Forward = rules
+		if errs := validateConfig(conf); len(errs) == 0 {
+			t.Errorf("expected error for %+v", rules)
+		}
+	}
+}
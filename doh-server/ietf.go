@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -18,7 +17,8 @@ import (
 	jsondns "github.com/stenstromen/dns-over-https/json-dns"
 )
 
-func (s *Server) parseRequestIETF(_ context.Context, w http.ResponseWriter, r *http.Request) *DNSRequest {
+func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r *http.Request) *DNSRequest {
+	conf := s.stateFrom(ctx).conf
 	requestBase64 := r.FormValue("dns")
 	requestBinary, err := base64.RawURLEncoding.DecodeString(requestBase64)
 	if err != nil {
@@ -58,84 +58,19 @@ func (s *Server) parseRequestIETF(_ context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
-	if s.conf.Verbose && len(msg.Question) > 0 {
-		question := &msg.Question[0]
-		questionName := question.Name
-		questionClass := ""
-		if qclass, ok := dns.ClassToString[question.Qclass]; ok {
-			questionClass = qclass
-		} else {
-			questionClass = strconv.FormatUint(uint64(question.Qclass), 10)
-		}
-		questionType := ""
-		if qtype, ok := dns.TypeToString[question.Qtype]; ok {
-			questionType = qtype
-		} else {
-			questionType = strconv.FormatUint(uint64(question.Qtype), 10)
-		}
-		var clientip net.IP = nil
-		if s.conf.LogGuessedIP {
-			clientip = s.findClientIP(r)
-		}
-		if clientip != nil {
-			fmt.Printf("%s - - [%s] \"%s %s %s\"\n", clientip, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType)
-		} else {
-			fmt.Printf("%s - - [%s] \"%s %s %s\"\n", r.RemoteAddr, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType)
+	if conf.Verbose && len(msg.Question) > 0 {
+		client := r.RemoteAddr
+		if conf.LogGuessedIP {
+			if clientip := s.findClientIP(r); clientip != nil {
+				client = clientip.String()
+			}
 		}
+		logQuestion(client, &msg.Question[0])
 	}
 
 	transactionID := msg.Id
 	msg.Id = dns.Id()
-	opt := msg.IsEdns0()
-	if opt == nil {
-		opt = new(dns.OPT)
-		opt.Hdr.Name = "."
-		opt.Hdr.Rrtype = dns.TypeOPT
-		opt.SetUDPSize(dns.DefaultMsgSize)
-		opt.SetDo(false)
-		msg.Extra = append([]dns.RR{opt}, msg.Extra...)
-	}
-	var edns0Subnet *dns.EDNS0_SUBNET
-	for _, option := range opt.Option {
-		if option.Option() == dns.EDNS0SUBNET {
-			edns0Subnet = option.(*dns.EDNS0_SUBNET)
-			break
-		}
-	}
-	isTailored := edns0Subnet == nil
-
-	if edns0Subnet == nil {
-		ednsClientFamily := uint16(0)
-		ednsClientAddress := s.findClientIP(r)
-		ednsClientNetmask := uint8(255)
-		if ednsClientAddress != nil {
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-				if s.conf.ECSUsePreciseIP {
-					ednsClientNetmask = 32
-				} else {
-					ednsClientNetmask = 24
-					ednsClientAddress = ednsClientAddress.Mask(net.CIDRMask(24, 32))
-				}
-			} else {
-				ednsClientFamily = 2
-				if s.conf.ECSUsePreciseIP {
-					ednsClientNetmask = 128
-				} else {
-					ednsClientNetmask = 56
-					ednsClientAddress = ednsClientAddress.Mask(net.CIDRMask(56, 128))
-				}
-			}
-			edns0Subnet = new(dns.EDNS0_SUBNET)
-			edns0Subnet.Code = dns.EDNS0SUBNET
-			edns0Subnet.Family = ednsClientFamily
-			edns0Subnet.SourceNetmask = ednsClientNetmask
-			edns0Subnet.SourceScope = 0
-			edns0Subnet.Address = ednsClientAddress
-			opt.Option = append(opt.Option, edns0Subnet)
-		}
-	}
+	isTailored := addClientSubnet(conf, msg, s.findClientIP(r))
 
 	return &DNSRequest{
 		request:       msg,
@@ -188,7 +123,7 @@ func (s *Server) generateResponseIETF(_ context.Context, w http.ResponseWriter,
 // Workaround a bug causing DNSCrypt-Proxy to expect a response with TransactionID = 0xcafe.
 func (s *Server) patchDNSCryptProxyReqID(w http.ResponseWriter, r *http.Request, requestBinary []byte) bool {
 	if strings.Contains(r.UserAgent(), "dnscrypt-proxy") && bytes.Equal(requestBinary, []byte("\xca\xfe\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x02\x00\x01\x00\x00\x29\x10\x00\x00\x00\x80\x00\x00\x00")) {
-		if s.conf.Verbose {
+		if s.stateFrom(r.Context()).conf.Verbose {
 			log.Println("DNSCrypt-Proxy detected. Patching response.")
 		}
 		w.Header().Set("Content-Type", "application/dns-message")
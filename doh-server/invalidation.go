@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long the invalidation subscription may stay silent before it is
+// pinged, and then considered lost.
+const invalidationPingInterval = 30 * time.Second
+
+// invalidation is the message published when a replica changes cache entries
+// that other replicas may hold in memory: entries refreshed or deleted under
+// Keys, and entries purged by Patterns.
+type invalidation struct {
+	Origin   string   `json:"origin"`
+	Keys     []string `json:"keys,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// cacheInvalidator keeps the memory caches of replicas sharing a Redis cache
+// coherent. It publishes the entries changed by this replica on a Redis
+// channel and evicts those changed by others from local.
+type cacheInvalidator struct {
+	client  redis.UniversalClient
+	channel string
+	// origin identifies this replica, to skip its own messages.
+	origin string
+	local  Cache
+}
+
+func newCacheInvalidator(client redis.UniversalClient, db int, local Cache) *cacheInvalidator {
+	hostname, _ := os.Hostname()
+	return &cacheInvalidator{
+		client: client,
+		// Pub/sub channels are shared by all databases.
+		channel: fmt.Sprintf("doh-server:invalidate:%d", db),
+		origin:  fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		local:   local,
+	}
+}
+
+func (inv *cacheInvalidator) publish(ctx context.Context, msg invalidation) error {
+	msg.Origin = inv.origin
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return inv.client.Publish(ctx, inv.channel, payload).Err()
+}
+
+// run subscribes to the invalidations of other replicas until ctx is done.
+// As messages may have been missed while the subscription was lost, the
+// local cache is flushed when it is back.
+func (inv *cacheInvalidator) run(ctx context.Context) {
+	for resubscribe := false; ; resubscribe = true {
+		err := inv.listen(ctx, resubscribe)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Cache invalidation subscription lost, resubscribing: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listen handles the messages of one subscription until it fails.
+func (inv *cacheInvalidator) listen(ctx context.Context, resubscribe bool) error {
+	pubsub := inv.client.Subscribe(ctx, inv.channel)
+	defer pubsub.Close()
+
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, invalidationPingInterval)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !pinged {
+			pinged = true
+			if err := pubsub.Ping(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pinged = false
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if resubscribe {
+				n, _ := inv.local.Purge(ctx, "dns:*")
+				log.Printf("Cache invalidation subscription restored, flushed %d entries from memory", n)
+			}
+		case *redis.Message:
+			inv.handle(ctx, msg.Payload)
+		}
+	}
+}
+
+// handle evicts the entries of an invalidation published by another replica
+// from the local cache.
+func (inv *cacheInvalidator) handle(ctx context.Context, payload string) {
+	var msg invalidation
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("Ignoring invalid cache invalidation %q: %v", payload, err)
+		return
+	}
+	if msg.Origin == inv.origin {
+		return
+	}
+	if len(msg.Keys) > 0 {
+		inv.local.Delete(ctx, msg.Keys...)
+	}
+	if len(msg.Patterns) > 0 {
+		inv.local.Purge(ctx, msg.Patterns...)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCacheInvalidatorHandle(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	local := newMemoryCache(10)
+	inv := newCacheInvalidator(nil, 0, local)
+	for _, key := range []string{"dns:a.example.com.:1:1:do=0:cd=0", "dns:b.example.com.:1:1:do=0:cd=0", "dns:example.org.:1:1:do=0:cd=0", "dns:example.net.:1:1:do=0:cd=0"} {
+		local.Set(ctx, key, []byte("entry"), time.Minute)
+	}
+	handle := func(msg invalidation) {
+		t.Helper()
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv.handle(ctx, string(payload))
+	}
+
+	// Messages of this replica were applied when published.
+	handle(invalidation{Origin: inv.origin, Keys: []string{"dns:example.org.:1:1:do=0:cd=0"}})
+	if local.Stats().Entries != 4 {
+		t.Error("own invalidation applied")
+	}
+
+	handle(invalidation{Origin: "other", Keys: []string{"dns:example.org.:1:1:do=0:cd=0"}})
+	handle(invalidation{Origin: "other", Patterns: []string{"dns:*.example.com.:*"}})
+	inv.handle(ctx, "garbage")
+	if _, _, err := local.Get(ctx, "dns:example.net.:1:1:do=0:cd=0"); err != nil || local.Stats().Entries != 1 {
+		t.Errorf("%d entries left, want only example.net", local.Stats().Entries)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryCache is a bounded in-process Cache, evicting the least recently used
+// entry when full.
+type memoryCache struct {
+	size int
+	cacheCounters
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type memoryCacheEntry struct {
+	key     string
+	entry   []byte
+	expires time.Time
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, 0, c.countGet(errCacheMiss)
+	}
+	e := elem.Value.(*memoryCacheEntry)
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		c.remove(elem)
+		return nil, 0, c.countGet(errCacheMiss)
+	}
+	c.lru.MoveToFront(elem)
+	return e.entry, ttl, c.countGet(nil)
+}
+
+func (c *memoryCache) Peek(_ context.Context, key string) ([]byte, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*memoryCacheEntry)
+		if ttl := time.Until(e.expires); ttl > 0 {
+			return e.entry, ttl, nil
+		}
+	}
+	return nil, 0, errCacheMiss
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, entry []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sets.Add(1)
+	expires := time.Now().Add(ttl)
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*memoryCacheEntry)
+		e.entry, e.expires = entry, expires
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, entry: entry, expires: expires})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) Delete(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+			c.deletes.Add(1)
+		}
+	}
+	return nil
+}
+
+func (c *memoryCache) Purge(_ context.Context, patterns ...string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, elem := range c.entries {
+		for _, pattern := range patterns {
+			if globMatch(pattern, key) {
+				c.remove(elem)
+				n++
+				break
+			}
+		}
+	}
+	c.deletes.Add(uint64(n))
+	return n, nil
+}
+
+// Range calls fn with a snapshot of the matching entries, taken under the
+// lock, so that fn may use the cache.
+func (c *memoryCache) Range(_ context.Context, pattern string, fn func(key string, entry []byte, ttl time.Duration) error) error {
+	now := time.Now()
+	var matched []memoryCacheEntry
+	c.mu.Lock()
+	for key, elem := range c.entries {
+		if e := elem.Value.(*memoryCacheEntry); e.expires.After(now) && globMatch(pattern, key) {
+			matched = append(matched, *e)
+		}
+	}
+	c.mu.Unlock()
+	for _, e := range matched {
+		if err := fn(e.key, e.entry, e.expires.Sub(now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return c.cacheCounters.stats("memory", entries)
+}
+
+func (c *memoryCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*memoryCacheEntry).key)
+}
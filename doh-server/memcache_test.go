@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	c := newMemoryCache(2)
+	c.Set(ctx, "a", []byte("a"), time.Minute)
+	c.Set(ctx, "b", []byte("b"), time.Minute)
+	if _, _, err := c.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(ctx, "c", []byte("c"), time.Minute)
+
+	if _, _, err := c.Get(ctx, "b"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("least recently used entry b was not evicted: %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ttl, err := c.Get(ctx, key); err != nil || ttl <= 0 || ttl > time.Minute {
+			t.Errorf("%s: ttl %s, err %v", key, ttl, err)
+		}
+	}
+
+	c.Set(ctx, "short", []byte("short"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := c.Get(ctx, "short"); !errors.Is(err, errCacheMiss) {
+		t.Error("expired entry returned")
+	}
+	c.Delete(ctx, "c")
+
+	stats := c.Stats()
+	if stats.Entries != 0 || stats.Hits != 3 || stats.Misses != 2 || stats.Sets != 4 || stats.Deletes != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	l1, l2 := newMemoryCache(10), newMemoryCache(10)
+	c := newTieredCache(l1, l2)
+
+	l2.Set(ctx, "shared", []byte("entry"), time.Minute)
+	// Peeking at an entry neither copies it to l1 nor counts.
+	if entry, _, err := c.Peek(ctx, "shared"); err != nil || string(entry) != "entry" {
+		t.Fatalf("Peek = %q, %v", entry, err)
+	}
+	if stats := c.Stats(); stats.Hits != 0 || stats.Entries != 0 {
+		t.Errorf("Peek changed the cache: %+v", stats)
+	}
+	if entry, _, err := c.Get(ctx, "shared"); err != nil || string(entry) != "entry" {
+		t.Fatalf("Get = %q, %v", entry, err)
+	}
+	if _, ttl, err := l1.Get(ctx, "shared"); err != nil || ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("entry copied to l1 with ttl %s, err %v", ttl, err)
+	}
+
+	c.Set(ctx, "new", []byte("entry"), time.Minute)
+	c.Delete(ctx, "shared")
+	for _, tier := range []Cache{l1, l2} {
+		if _, _, err := tier.Get(ctx, "new"); err != nil {
+			t.Errorf("%T: entry not set", tier)
+		}
+		if _, _, err := tier.Get(ctx, "shared"); err == nil {
+			t.Errorf("%T: entry not deleted", tier)
+		}
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMemoryCacheWithoutRedis(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA(w, r)
+	})
+	server := &Server{cache: newMemoryCache(10)}
+	server.state.Store(newTestState(t, "random", "udp:"+addr))
+
+	for i := range 3 {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		req := &DNSRequest{request: msg}
+		if err := server.doDNSQuery(t.Context(), req); err != nil {
+			t.Fatal(err)
+		}
+		if req.fromCache != (i > 0) {
+			t.Errorf("query %d: fromCache = %v", i, req.fromCache)
+		}
+		if len(req.response.Answer) != 1 {
+			t.Errorf("query %d: unexpected response %v", i, req.response)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// selectionPolicy chooses the upstream for the next try of a query.
+// candidates is never empty and only contains upstreams of the same priority,
+// in configuration order.
+type selectionPolicy interface {
+	pick(candidates []*upstream) *upstream
+}
+
+// Names accepted by the upstream_policy option.
+var selectionPolicies = map[string]func() selectionPolicy{
+	"random":      func() selectionPolicy { return randomPolicy{} },
+	"failover":    func() selectionPolicy { return failoverPolicy{} },
+	"round_robin": func() selectionPolicy { return &roundRobinPolicy{} },
+	"ewma":        func() selectionPolicy { return ewmaPolicy{} },
+}
+
+// randomPolicy picks a random upstream, proportionally to its weight.
+type randomPolicy struct{}
+
+func (randomPolicy) pick(candidates []*upstream) *upstream {
+	total := 0
+	for _, u := range candidates {
+		total += u.weight
+	}
+	n := rand.Intn(total)
+	for _, u := range candidates {
+		if n < u.weight {
+			return u
+		}
+		n -= u.weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// failoverPolicy always picks the first upstream, the next one is only used
+// once the first has been tried or ejected.
+type failoverPolicy struct{}
+
+func (failoverPolicy) pick(candidates []*upstream) *upstream {
+	return candidates[0]
+}
+
+// roundRobinPolicy is a smooth weighted round-robin, as used by nginx. An
+// upstream of weight 2 is picked twice as often as one of weight 1, and picks
+// of the same upstream are spread out as evenly as possible.
+type roundRobinPolicy struct {
+	mu      sync.Mutex
+	current map[*upstream]int
+}
+
+func (p *roundRobinPolicy) pick(candidates []*upstream) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		p.current = make(map[*upstream]int)
+	}
+
+	var best *upstream
+	total := 0
+	for _, u := range candidates {
+		p.current[u] += u.weight
+		total += u.weight
+		if best == nil || p.current[u] > p.current[best] {
+			best = u
+		}
+	}
+	p.current[best] -= total
+	return best
+}
+
+// Probability of the ewma policy picking a random upstream, so that the
+// latency of the others keeps being measured.
+const ewmaExplore = 0.05
+
+// ewmaPolicy picks the upstream with the lowest moving average latency.
+// Upstreams without any measurement yet are tried first.
+type ewmaPolicy struct{}
+
+func (ewmaPolicy) pick(candidates []*upstream) *upstream {
+	if len(candidates) > 1 && rand.Float64() < ewmaExplore {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	var best *upstream
+	var bestLatency float64
+	for _, u := range candidates {
+		latency, measured := u.health.latency()
+		if !measured {
+			return u
+		}
+		if best == nil || latency < bestLatency {
+			best, bestLatency = u, latency
+		}
+	}
+	return best
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestState(t *testing.T, policy string, upstreams ...string) *serverState {
+	t.Helper()
+	conf := defaultConfig()
+	conf.Upstream = upstreams
+	conf.UpstreamPolicy = policy
+	state, err := newServerState(conf, &healthRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestParseUpstreamOptions(t *testing.T) {
+	t.Parallel()
+	u, err := parseUpstream("udp:192.0.2.1:53;weight=3;priority=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.addr != "192.0.2.1:53" || u.typ != "udp" || u.weight != 3 || u.priority != 1 {
+		t.Errorf("unexpected upstream %+v", u)
+	}
+
+	for _, us := range []string{
+		"udp:192.0.2.1:53;weight=0",
+		"udp:192.0.2.1:53;weight=x",
+		"udp:192.0.2.1:53;priority=-1",
+		"udp:192.0.2.1:53;color=blue",
+	} {
+		if _, err := parseUpstream(us); err == nil {
+			t.Errorf("expected error for %q", us)
+		}
+	}
+}
+
+func TestFailoverPolicy(t *testing.T) {
+	t.Parallel()
+	state := newTestState(t, "failover",
+		"udp:192.0.2.2:53;priority=1",
+		"udp:192.0.2.1:53",
+		"udp:192.0.2.3:53",
+	)
+	primary, fallback := state.upstreams[1], state.upstreams[0]
+
+	tried := map[*upstream]bool{}
+	for _, want := range []*upstream{primary, state.upstreams[2], fallback, primary} {
+		u := state.defaultGroup.pickUpstream(tried)
+		if u != want {
+			t.Fatalf("picked %s, want %s", u.name, want.name)
+		}
+		tried[u] = true
+		if len(tried) == len(state.upstreams) {
+			tried = map[*upstream]bool{}
+		}
+	}
+
+	primary.health.ejected = true
+	if u := state.defaultGroup.pickUpstream(nil); u != state.upstreams[2] {
+		t.Errorf("picked %s after primary was ejected", u.name)
+	}
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	t.Parallel()
+	state := newTestState(t, "round_robin",
+		"udp:192.0.2.1:53;weight=2",
+		"udp:192.0.2.2:53",
+	)
+
+	picks := map[*upstream]int{}
+	for range 30 {
+		picks[state.defaultGroup.pickUpstream(nil)]++
+	}
+	if picks[state.upstreams[0]] != 20 || picks[state.upstreams[1]] != 10 {
+		t.Errorf("unexpected distribution %d/%d", picks[state.upstreams[0]], picks[state.upstreams[1]])
+	}
+}
+
+func TestEWMAPolicy(t *testing.T) {
+	t.Parallel()
+	state := newTestState(t, "ewma",
+		"udp:192.0.2.1:53",
+		"udp:192.0.2.2:53",
+	)
+	slow, fast := state.upstreams[0], state.upstreams[1]
+	slow.health.observe(slow.name, nil, 80*time.Millisecond, 0, 1)
+	fast.health.observe(fast.name, nil, 5*time.Millisecond, 0, 1)
+
+	picks := map[*upstream]int{}
+	for range 1000 {
+		picks[state.defaultGroup.pickUpstream(nil)]++
+	}
+	if picks[fast] < 900 {
+		t.Errorf("fast upstream picked %d out of 1000 times", picks[fast])
+	}
+	if picks[slow] == 0 {
+		t.Error("slow upstream was never explored")
+	}
+}
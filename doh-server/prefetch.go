@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Length of the windows hits are counted over.
+const hitCountWindow = time.Minute
+
+// Maximum number of keys hits are counted for in a window. Keys requested
+// first once it is reached are not counted, so that a flood of random names
+// cannot exhaust memory.
+const maxHitKeys = 1 << 16
+
+// hitCounter counts the requests for each cache key over the current and the
+// previous hitCountWindow, for at most maxHitKeys keys in each.
+type hitCounter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	current     map[string]*hitCount
+	previous    map[string]*hitCount
+}
+
+type hitCount struct {
+	question dns.Question
+	hits     uint64
+}
+
+// add counts a request for question under key and returns the number of
+// requests for key in the last one to two windows.
+func (c *hitCounter) add(key string, question dns.Question, now time.Time) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(now)
+	var hits uint64
+	if previous := c.previous[key]; previous != nil {
+		hits = previous.hits
+	}
+	count := c.current[key]
+	if count == nil {
+		if len(c.current) >= maxHitKeys {
+			return hits
+		}
+		count = &hitCount{question: question}
+		c.current[key] = count
+	}
+	count.hits++
+	return hits + count.hits
+}
+
+// top returns the questions requested most in the last one to two windows,
+// at most limit of them. Variants of a question, such as with the DO bit or
+// for another client subnet, are counted together.
+func (c *hitCounter) top(limit int, now time.Time) []dns.Question {
+	c.mu.Lock()
+	totals := make(map[dns.Question]uint64)
+	c.rotate(now)
+	for _, counts := range []map[string]*hitCount{c.previous, c.current} {
+		for _, count := range counts {
+			q := count.question
+			q.Name = strings.ToLower(dns.CanonicalName(q.Name))
+			totals[q] += count.hits
+		}
+	}
+	c.mu.Unlock()
+
+	questions := slices.Collect(maps.Keys(totals))
+	slices.SortFunc(questions, func(a, b dns.Question) int {
+		return cmp.Or(
+			cmp.Compare(totals[b], totals[a]),
+			strings.Compare(a.Name, b.Name),
+			cmp.Compare(a.Qtype, b.Qtype),
+		)
+	})
+	return questions[:min(limit, len(questions))]
+}
+
+func (c *hitCounter) rotate(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if c.current != nil && elapsed < hitCountWindow {
+		return
+	}
+	if elapsed < 2*hitCountWindow {
+		c.previous = c.current
+	} else {
+		c.previous = nil
+	}
+	c.current = make(map[string]*hitCount, len(c.previous))
+	c.windowStart = now
+}
+
+// Maximum number of cache refreshes running at once. Prefetches beyond this
+// are skipped, the entry is refreshed on expiry as usual.
+const maxRefreshes = 16
+
+// shouldPrefetch reports whether the fresh cache entry, stored at storedAt
+// for ttl seconds and requested hits times recently, is to be refreshed
+// ahead of expiry: when it is in the last prefetch_window percent of its TTL
+// and was requested at least prefetch_threshold times.
+func shouldPrefetch(conf *config, storedAt time.Time, ttl uint32, hits uint64, now time.Time) bool {
+	if conf.PrefetchWindow == 0 || hits < uint64(conf.PrefetchThreshold) {
+		return false
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	remaining := storedAt.Add(lifetime).Sub(now)
+	return remaining <= lifetime*time.Duration(conf.PrefetchWindow)/100
+}
+
+// countHit counts req, answered by the cache entry stored under key, and
+// returns the hits of key, see hitCounter. Hits are only counted for
+// prefetching and the /cache/top admin endpoint, and not for warm-up queries.
+func (s *Server) countHit(conf *config, key string, req *DNSRequest, now time.Time) uint64 {
+	if req.warmup || conf.PrefetchWindow == 0 && conf.AdminToken == "" {
+		return 0
+	}
+	return s.hits.add(key, req.request.Question[0], now)
+}
+
+// refreshCache queries the upstreams for request in the background and
+// caches the answer, to refresh the entry stored under key. A refresh of key
+// already running, or too many refreshes running, make it a no-op.
+func (s *Server) refreshCache(key string, keys cacheKeys, request *dns.Msg) {
+	if _, running := s.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+	select {
+	case s.refreshSlots <- struct{}{}:
+	default:
+		s.refreshing.Delete(key)
+		return
+	}
+	go func() {
+		defer func() {
+			<-s.refreshSlots
+			s.refreshing.Delete(key)
+		}()
+		req := &DNSRequest{
+			request: request,
+			refresh: true,
+		}
+		s.resolve(context.Background(), keys, req)
+	}()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHitCounter(t *testing.T) {
+	var c hitCounter
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	start := time.Now()
+	for i := range 3 {
+		if n := c.add("a", q, start); n != uint64(i+1) {
+			t.Fatalf("hit %d counted as %d", i+1, n)
+		}
+	}
+	// Hits of the previous window still count...
+	if n := c.add("a", q, start.Add(hitCountWindow)); n != 4 {
+		t.Errorf("got %d hits after one window, want 4", n)
+	}
+	// ...but not those of older ones.
+	if n := c.add("a", q, start.Add(2*hitCountWindow)); n != 2 {
+		t.Errorf("got %d hits after two windows, want 2", n)
+	}
+	if n := c.add("a", q, start.Add(5*hitCountWindow)); n != 1 {
+		t.Errorf("got %d hits after an idle window, want 1", n)
+	}
+
+	// Keys beyond maxHitKeys are not tracked, known ones still are.
+	for i := range maxHitKeys {
+		c.add(strconv.Itoa(i), q, start.Add(5*hitCountWindow))
+	}
+	if n := c.add("new", q, start.Add(5*hitCountWindow)); n != 0 {
+		t.Errorf("got %d hits for a key beyond maxHitKeys, want 0", n)
+	}
+	if n := c.add("a", q, start.Add(5*hitCountWindow)); n != 2 {
+		t.Errorf("got %d hits for a known key, want 2", n)
+	}
+}
+
+func TestShouldPrefetch(t *testing.T) {
+	conf := defaultConfig()
+	conf.PrefetchWindow = 10
+	now := time.Now()
+	tests := []struct {
+		age  time.Duration
+		hits uint64
+		want bool
+	}{
+		{age: 50 * time.Second, hits: 5, want: false},
+		{age: 55 * time.Second, hits: 5, want: true},
+		{age: 55 * time.Second, hits: 1, want: false},
+	}
+	for _, tt := range tests {
+		if got := shouldPrefetch(conf, now.Add(-tt.age), 60, tt.hits, now); got != tt.want {
+			t.Errorf("shouldPrefetch(age %s, %d hits) = %v, want %v", tt.age, tt.hits, got, tt.want)
+		}
+	}
+	conf.PrefetchWindow = 0
+	if shouldPrefetch(conf, now.Add(-59*time.Second), 60, 100, now) {
+		t.Error("prefetched with prefetch_window = 0")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA(w, r)
+	})
+	cache := newMemoryCache(10)
+	server := &Server{cache: cache, refreshSlots: make(chan struct{}, maxRefreshes)}
+	state := newTestState(t, "random", "udp:"+addr)
+	state.conf.PrefetchWindow = 10
+	state.conf.PrefetchThreshold = 2
+	server.state.Store(state)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	keys, _ := newCacheKeys(msg)
+	storedAt := time.Now().Add(-55 * time.Second)
+	entry, err := packCacheEntry(state.conf, testResponse(60, 60), 60, storedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set(t.Context(), keys.global, entry, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func() {
+		t.Helper()
+		req := &DNSRequest{request: msg.Copy()}
+		if err := server.doDNSQuery(t.Context(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !req.fromCache {
+			t.Fatal("answer not served from the cache")
+		}
+	}
+
+	// Below the threshold, the entry is left to expire.
+	query()
+	time.Sleep(100 * time.Millisecond)
+	if n := queries.Load(); n != 0 {
+		t.Fatalf("%d upstream queries below the prefetch threshold", n)
+	}
+
+	// Popular names are refreshed once, however many requests follow.
+	for range 5 {
+		query()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d prefetches, want 1", n)
+	}
+	entry, _, err = cache.Get(t.Context(), keys.global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed, _, _ := cacheEntryHeader(entry); !refreshed.After(storedAt) {
+		t.Error("cache entry not refreshed by the prefetch")
+	}
+}
+
+func TestPrefetchAcrossSubnets(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA(w, r)
+	})
+	cache := newMemoryCache(10)
+	server := &Server{cache: cache, refreshSlots: make(chan struct{}, maxRefreshes)}
+	state := newTestState(t, "random", "udp:"+addr)
+	state.conf.PrefetchWindow = 10
+	state.conf.PrefetchThreshold = 4
+	server.state.Store(state)
+
+	// DoH requests carry the subnet of their client, the upstream answers
+	// for every client.
+	query := func(subnet byte) {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(198, 51, subnet, 0)})
+		if err := server.doDNSQuery(t.Context(), &DNSRequest{request: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	keys, _ := newCacheKeys(msg)
+
+	// The miss and the hits of the global entry count together.
+	for subnet := range byte(3) {
+		query(subnet)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("%d upstream queries, want 1", n)
+	}
+	if n := server.hits.add(keys.global, msg.Question[0], time.Now()); n != 4 {
+		t.Errorf("%d hits counted for the global entry, want 4", n)
+	}
+
+	// Popular global entries are refreshed once, whatever the subnets of
+	// the clients asking for them.
+	storedAt := time.Now().Add(-55 * time.Second)
+	entry, err := packCacheEntry(state.conf, testResponse(60, 60), 60, storedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set(t.Context(), keys.global, entry, time.Minute)
+	for subnet := range byte(8) {
+		query(10 + subnet)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d prefetches, want 1", n-1)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often the configuration file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+func statConfig(path string) (fileVersion, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: fi.ModTime().UnixNano(), size: fi.Size()}, nil
+}
+
+// watchReload reloads the configuration on SIGHUP and, when a configuration
+// file is used, whenever that file changes.
+func (s *Server) watchReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var poll <-chan time.Time
+	var lastVersion fileVersion
+	if s.configPath != "" {
+		lastVersion, _ = statConfig(s.configPath)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-sighup:
+			log.Println("Received SIGHUP, reloading configuration")
+			s.reload()
+		case <-poll:
+			version, err := statConfig(s.configPath)
+			if err != nil || version == lastVersion {
+				continue
+			}
+			lastVersion = version
+			log.Printf("Configuration file %s changed, reloading", s.configPath)
+			s.reload()
+		}
+	}
+}
+
+// reload builds a new state from the configuration and swaps it in. Requests
+// already in flight finish with the state they started with.
+func (s *Server) reload() error {
+	conf, err := loadConfig(s.configPath)
+	if err != nil {
+		log.Printf("Configuration reload rejected: %v", err)
+		return err
+	}
+
+	old := s.state.Load()
+	if err := checkRestartOptions(old.conf, conf); err != nil {
+		log.Printf("Configuration reload rejected: %v", err)
+		return err
+	}
+
+	state, err := newServerState(conf, &s.health)
+	if err != nil {
+		log.Printf("Configuration reload rejected: %v", err)
+		return err
+	}
+
+	changed := changedOptions(old.conf, conf)
+	if conf.Verbose {
+		s.enableFlightRecorder()
+	}
+	s.state.Store(state)
+	s.health.retain(state.upstreams)
+	// Requests started before the swap may still use the old state.
+	time.AfterFunc(time.Duration(old.conf.Timeout*old.conf.Tries)*time.Second, old.close)
+	if len(changed) == 0 {
+		log.Println("Configuration reloaded, no changes")
+	} else {
+		log.Printf("Configuration reloaded, changed: %s", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// checkRestartOptions rejects changes to options that are only applied at
+// startup, since they would silently be ignored otherwise.
+func checkRestartOptions(old, conf *config) error {
+	if !reflect.DeepEqual(old.Listen, conf.Listen) {
+		return &configError{"option \"listen\" cannot be changed without a restart"}
+	}
+	if !reflect.DeepEqual(old.DNSListen, conf.DNSListen) {
+		return &configError{"option \"dns_listen\" cannot be changed without a restart"}
+	}
+	if old.Path != conf.Path {
+		return &configError{"option \"path\" cannot be changed without a restart"}
+	}
+	if old.RedisURL != conf.RedisURL || old.RedisSentinelMaster != conf.RedisSentinelMaster ||
+		!reflect.DeepEqual(old.RedisSentinelAddrs, conf.RedisSentinelAddrs) ||
+		!reflect.DeepEqual(old.RedisClusterNodes, conf.RedisClusterNodes) {
+		return &configError{"Redis options cannot be changed without a restart"}
+	}
+	if old.CacheBackend != conf.CacheBackend {
+		return &configError{"option \"cache_backend\" cannot be changed without a restart"}
+	}
+	if old.MemoryCacheSize != conf.MemoryCacheSize {
+		return &configError{"option \"memory_cache_size\" cannot be changed without a restart"}
+	}
+	if old.AdminListen != conf.AdminListen {
+		return &configError{"option \"admin_listen\" cannot be changed without a restart"}
+	}
+	if (old.Cert == "" && old.Key == "") != (conf.Cert == "" && conf.Key == "") {
+		return &configError{"switching between HTTP and HTTPS requires a restart"}
+	}
+	return nil
+}
+
+// changedOptions returns the TOML keys whose values differ between old and conf.
+func changedOptions(old, conf *config) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(conf).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			field := oldValue.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			changed = append(changed, fmt.Sprintf("%q", name))
+		}
+	}
+	return changed
+}
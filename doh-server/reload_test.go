@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	path := writeConfigFile(t, `
+listen = ["127.0.0.1:8053"]
+upstream = ["udp:127.0.0.1:53"]
+timeout = 5
+`)
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := server.state.Load()
+
+	if err := os.WriteFile(path, []byte(`
+listen = ["127.0.0.1:8053"]
+upstream = ["udp:127.0.0.1:53", "tcp:127.0.0.2:53"]
+timeout = 2
+debug_http_headers = ["CF-Ray"]
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.reload(); err != nil {
+		t.Fatal(err)
+	}
+	state := server.state.Load()
+	if state == old {
+		t.Fatal("state was not swapped")
+	}
+	if len(state.conf.Upstream) != 2 || state.udpClient.Timeout != 2e9 {
+		t.Errorf("new state not applied: upstream = %v, timeout = %v", state.conf.Upstream, state.udpClient.Timeout)
+	}
+	if old.conf.Timeout != 5 {
+		t.Errorf("old state was modified: timeout = %d", old.conf.Timeout)
+	}
+	changed := changedOptions(old.conf, state.conf)
+	if want := []string{`"debug_http_headers"`, `"upstream"`, `"timeout"`}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+
+	// Turning verbose on creates the flight recorder.
+	if server.flightRec.Load() != nil {
+		t.Error("flight recorder created without verbose")
+	}
+	if err := os.WriteFile(path, []byte(`
+listen = ["127.0.0.1:8053"]
+upstream = ["udp:127.0.0.1:53"]
+verbose = true
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if server.flightRec.Load() == nil {
+		t.Error("flight recorder not created when verbose was turned on")
+	}
+	state = server.state.Load()
+
+	if err := os.WriteFile(path, []byte(`
+listen = ["127.0.0.1:9053"]
+upstream = ["udp:127.0.0.1:53"]
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.reload(); err == nil {
+		t.Error("expected listen change to be rejected")
+	}
+	if server.state.Load() != state {
+		t.Error("rejected reload replaced the state")
+	}
+}
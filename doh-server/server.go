@@ -1,12 +1,12 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -14,25 +14,52 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/miekg/dns"
-	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 
 	jsondns "github.com/stenstromen/dns-over-https/json-dns"
 )
 
 type Server struct {
-	conf         *config
-	udpClient    *dns.Client
-	tcpClient    *dns.Client
-	tcpClientTLS *dns.Client
-	servemux     *http.ServeMux
-	redis        *redis.Client
-	flightRec    *trace.FlightRecorder
+	configPath string
+	state      atomic.Pointer[serverState]
+	health     healthRegistry
+	servemux   *http.ServeMux
+	cache      Cache
+	// flightRec is created once verbose is first enabled, see
+	// enableFlightRecorder.
+	flightRec     atomic.Pointer[trace.FlightRecorder]
+	flightRecOnce sync.Once
+	// queries coalesces identical upstream queries in flight, keyed by
+	// cache key.
+	queries singleflight.Group
+	hits    hitCounter
+	// refreshing holds the keys of the cache entries being refreshed, by
+	// prefetches, at most maxRefreshes, or after serving them stale.
+	refreshing   sync.Map
+	refreshSlots chan struct{}
 }
 
+// serverState holds everything derived from the configuration that may change
+// on a reload. A request keeps using the state it started with, see stateFrom.
+type serverState struct {
+	conf      *config
+	udpClient *dns.Client
+	tcpClient *dns.Client
+	tlsConfig *tls.Config
+	// upstreams holds every upstream once, also those only used by forward
+	// rules.
+	upstreams    []*upstream
+	defaultGroup *upstreamGroup
+	forward      map[string]*upstreamGroup
+}
+
+type stateContextKey struct{}
+
 type DNSRequest struct {
 	request         *dns.Msg
 	response        *dns.Msg
@@ -42,133 +69,233 @@ type DNSRequest struct {
 	transactionID   uint16
 	isTailored      bool
 	fromCache       bool
+	// refresh is set when the response replaces a cache entry that other
+	// replicas may still hold.
+	refresh bool
+	// warmup is set for cache warm-up queries, which are not counted as
+	// hits.
+	warmup bool
 }
 
-func NewServer(conf *config) (*Server, error) {
-	// Override config with environment variables if present
-	if upstreamDNS := os.Getenv("UPSTREAM_DNS_SERVER"); upstreamDNS != "" {
-		conf.Upstream = []string{upstreamDNS}
+func NewServer(configPath string, conf *config) (*Server, error) {
+	server := &Server{
+		configPath:   configPath,
+		refreshSlots: make(chan struct{}, maxRefreshes),
 	}
-
-	if prefix := os.Getenv("DOH_HTTP_PREFIX"); prefix != "" {
-		conf.Path = prefix
+	state, err := newServerState(conf, &server.health)
+	if err != nil {
+		return nil, err
 	}
+	server.state.Store(state)
 
-	if listen := os.Getenv("DOH_SERVER_LISTEN"); listen != "" {
-		conf.Listen = []string{listen}
+	if conf.Verbose {
+		server.enableFlightRecorder()
 	}
 
-	if timeout := os.Getenv("DOH_SERVER_TIMEOUT"); timeout != "" {
-		if t, err := strconv.Atoi(timeout); err == nil {
-			conf.Timeout = uint(t)
-		}
+	server.cache, err = newCache(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	if tries := os.Getenv("DOH_SERVER_TRIES"); tries != "" {
-		if t, err := strconv.Atoi(tries); err == nil {
-			conf.Tries = uint(t)
-		}
-	}
+	server.servemux = http.NewServeMux()
+	server.servemux.HandleFunc(conf.Path, server.handlerFunc)
+	return server, nil
+}
 
-	if verbose := os.Getenv("DOH_SERVER_VERBOSE"); verbose != "" {
-		conf.Verbose = verbose == "true"
-	}
+// enableFlightRecorder creates the flight recorder written on panics while
+// verbose is set. It stays around when verbose is turned off by a reload.
+func (s *Server) enableFlightRecorder() {
+	s.flightRecOnce.Do(func() {
+		s.flightRec.Store(trace.NewFlightRecorder(trace.FlightRecorderConfig{}))
+	})
+}
 
-	server := &Server{
-		conf: conf,
+func newServerState(conf *config, health *healthRegistry) (*serverState, error) {
+	state := &serverState{
+		conf:    conf,
+		forward: make(map[string]*upstreamGroup),
 	}
-
-	if conf.Verbose {
-		server.flightRec = trace.NewFlightRecorder(trace.FlightRecorderConfig{})
+	var err error
+	state.defaultGroup, err = state.newUpstreamGroup(conf.Upstream, conf.UpstreamPolicy, health)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range conf.Forward {
+		group, err := state.newUpstreamGroup(rule.Upstream, cmp.Or(rule.UpstreamPolicy, conf.UpstreamPolicy), health)
+		if err != nil {
+			return nil, err
+		}
+		for _, suffix := range rule.Suffix {
+			state.forward[dns.CanonicalName(suffix)] = group
+		}
 	}
 
-	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
-		server.redis = redis.NewClient(&redis.Options{
-			Addr: redisURL,
-		})
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		_, err := server.redis.Ping(ctx).Result()
+	timeout := time.Duration(conf.Timeout) * time.Second
+	udpDialer := &net.Dialer{Timeout: timeout}
+	tcpDialer := &net.Dialer{Timeout: timeout}
+	if conf.LocalAddr != "" {
+		udpLocalAddr, err := net.ResolveUDPAddr("udp", conf.LocalAddr)
 		if err != nil {
-			log.Printf("Failed to connect to Redis at %s: %v", redisURL, err)
-			server.redis = nil
-		} else {
-			log.Printf("Successfully connected to Redis at %s", redisURL)
+			return nil, fmt.Errorf("invalid local_addr %q: %w", conf.LocalAddr, err)
+		}
+		tcpLocalAddr, err := net.ResolveTCPAddr("tcp", conf.LocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local_addr %q: %w", conf.LocalAddr, err)
 		}
+		udpDialer.LocalAddr = udpLocalAddr
+		tcpDialer.LocalAddr = tcpLocalAddr
 	}
 
-	server.udpClient = &dns.Client{
+	state.udpClient = &dns.Client{
 		Net:     "udp",
 		UDPSize: dns.DefaultMsgSize,
-		Timeout: time.Duration(conf.Timeout) * time.Second,
+		Dialer:  udpDialer,
+		Timeout: timeout,
 	}
-	server.tcpClient = &dns.Client{
+	state.tcpClient = &dns.Client{
 		Net:     "tcp",
-		Timeout: time.Duration(conf.Timeout) * time.Second,
+		Dialer:  tcpDialer,
+		Timeout: timeout,
 	}
-	server.tcpClientTLS = &dns.Client{
-		Net:     "tcp-tls",
-		Timeout: time.Duration(conf.Timeout) * time.Second,
+	for _, u := range state.upstreams {
+		if !u.usesTLS() {
+			continue
+		}
+		tlsConfig, err := upstreamTLSConfig(conf, u)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", u.name, err)
+		}
+		switch u.typ {
+		case "tcp-tls":
+			u.dotClient = &dns.Client{
+				Net:       "tcp-tls",
+				Dialer:    tcpDialer,
+				Timeout:   timeout,
+				TLSConfig: tlsConfig,
+			}
+		case "https":
+			u.httpClient = &http.Client{
+				Transport: &http.Transport{
+					DialContext:         tcpDialer.DialContext,
+					TLSClientConfig:     tlsConfig,
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: 16,
+					IdleConnTimeout:     90 * time.Second,
+					TLSHandshakeTimeout: timeout,
+				},
+				Timeout: timeout,
+			}
+		case "quic":
+			u.doq = newDoQConn(u.addr, tlsConfig, timeout)
+		}
 	}
-	server.servemux = http.NewServeMux()
-	server.servemux.HandleFunc(conf.Path, server.handlerFunc)
-	return server, nil
+	if conf.UpstreamPoolSize > 0 {
+		idleTimeout := time.Duration(conf.UpstreamIdleTimeout) * time.Second
+		for _, u := range state.upstreams {
+			switch u.typ {
+			case "udp", "tcp":
+				u.pool = newConnPool(u.addr, state.tcpClient, int(conf.UpstreamPoolSize), idleTimeout)
+			case "tcp-tls":
+				u.pool = newConnPool(u.addr, u.dotClient, int(conf.UpstreamPoolSize), idleTimeout)
+			}
+		}
+	}
+
+	if conf.Cert != "" || conf.Key != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading server certificate key pair: %w", err)
+		}
+		state.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+		if conf.TLSClientAuth {
+			clientCA, err := os.ReadFile(conf.TLSClientAuthCA)
+			if err != nil {
+				return nil, fmt.Errorf("reading certificate for client authentication: %w", err)
+			}
+			state.tlsConfig.ClientCAs = x509.NewCertPool()
+			state.tlsConfig.ClientCAs.AppendCertsFromPEM(clientCA)
+			state.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return state, nil
+}
+
+// close releases the connections held by st, once no request uses it anymore.
+func (st *serverState) close() {
+	for _, u := range st.upstreams {
+		if u.doq != nil {
+			u.doq.close()
+		}
+		if u.httpClient != nil {
+			u.httpClient.CloseIdleConnections()
+		}
+		if u.pool != nil {
+			u.pool.close()
+		}
+	}
+}
+
+// stateFrom returns the state snapshot the request in ctx was started with,
+// or the current state outside of a request.
+func (s *Server) stateFrom(ctx context.Context) *serverState {
+	if state, ok := ctx.Value(stateContextKey{}).(*serverState); ok {
+		return state
+	}
+	return s.state.Load()
 }
 
 func (s *Server) Start() error {
 	servemux := http.Handler(s.servemux)
-	if s.conf.Verbose {
-		servemux = handlers.CombinedLoggingHandler(os.Stdout, servemux)
+	loggedServemux := handlers.CombinedLoggingHandler(os.Stdout, servemux)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.state.Load().conf.Verbose {
+			loggedServemux.ServeHTTP(w, r)
+		} else {
+			servemux.ServeHTTP(w, r)
+		}
+	})
+
+	state := s.state.Load()
+	if state.conf.TLSClientAuth {
+		log.Println("Certificate loaded for client TLS authentication")
 	}
 
-	var clientCAPool *x509.CertPool
-	if s.conf.TLSClientAuth {
-		if s.conf.TLSClientAuthCA != "" {
-			clientCA, err := os.ReadFile(s.conf.TLSClientAuthCA)
-			if err != nil {
-				log.Fatalf("Reading certificate for client authentication has failed: %v", err)
+	go s.watchReload()
+	go s.healthCheck()
+	go s.logRaceWins()
+
+	if state.conf.AdminListen != "" {
+		go func() {
+			log.Printf("Admin endpoint listening on %s", state.conf.AdminListen)
+			if err := s.listenHTTP(state.conf.AdminListen, s.adminHandler(), state.tlsConfig != nil); err != nil {
+				log.Printf("Admin endpoint failed: %v", err)
 			}
-			clientCAPool = x509.NewCertPool()
-			clientCAPool.AppendCertsFromPEM(clientCA)
-			log.Println("Certificate loaded for client TLS authentication")
-		} else {
-			log.Fatalln("TLS client authentication requires both tls_client_auth and tls_client_auth_ca, exiting.")
-		}
+		}()
 	}
 
+	s.warmCache(context.Background())
+
+	dnsServers := s.dnsServers(state.conf)
 	var wg sync.WaitGroup
-	results := make(chan error, len(s.conf.Listen))
+	results := make(chan error, len(state.conf.Listen)+len(dnsServers))
 
-	for _, addr := range s.conf.Listen {
+	for _, server := range dnsServers {
 		wg.Go(func() {
-			var err error
-			if s.conf.Cert != "" || s.conf.Key != "" {
-				if clientCAPool != nil {
-					srvtls := &http.Server{
-						Handler: servemux,
-						Addr:    addr,
-						TLSConfig: &tls.Config{
-							ClientCAs:  clientCAPool,
-							ClientAuth: tls.RequireAndVerifyClientCert,
-							GetCertificate: func(info *tls.ClientHelloInfo) (certificate *tls.Certificate, e error) {
-								c, err := tls.LoadX509KeyPair(s.conf.Cert, s.conf.Key)
-								if err != nil {
-									fmt.Printf("Error loading server certificate key pair: %v\n", err)
-									return nil, err
-								}
-								return &c, nil
-							},
-						},
-					}
-					err = srvtls.ListenAndServeTLS("", "")
-				} else {
-					err = http.ListenAndServeTLS(addr, s.conf.Cert, s.conf.Key, servemux)
-				}
-			} else {
-				err = http.ListenAndServe(addr, servemux)
+			err := listenDNS(server)
+			if err != nil {
+				log.Println(err)
 			}
+			results <- err
+		})
+	}
+
+	for _, addr := range state.conf.Listen {
+		wg.Go(func() {
+			err := s.listenHTTP(addr, handler, state.tlsConfig != nil)
 			if err != nil {
 				log.Println(err)
 			}
@@ -187,15 +314,37 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// listenHTTP serves handler on addr, over HTTPS with the certificate of the
+// current state if useTLS is set.
+func (s *Server) listenHTTP(addr string, handler http.Handler, useTLS bool) error {
+	if !useTLS {
+		return http.ListenAndServe(addr, handler)
+	}
+	srvtls := &http.Server{
+		Handler: handler,
+		Addr:    addr,
+		TLSConfig: &tls.Config{
+			// Serve the certificate and client CAs of the current state so
+			// that a reload picks them up.
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.state.Load().tlsConfig, nil
+			},
+		},
+	}
+	return srvtls.ListenAndServeTLS("", "")
+}
+
 func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	state := s.state.Load()
+	ctx := context.WithValue(r.Context(), stateContextKey{}, state)
+	r = r.WithContext(ctx)
 
-	if s.flightRec != nil {
+	if flightRec := s.flightRec.Load(); flightRec != nil && state.conf.Verbose {
 		defer func() {
 			if r := recover(); r != nil {
 				// Write trace on panic for debugging
 				if f, err := os.Create(fmt.Sprintf("trace-panic-%d.trace", time.Now().Unix())); err == nil {
-					s.flightRec.WriteTo(f)
+					flightRec.WriteTo(f)
 					f.Close()
 				}
 				panic(r)
@@ -228,7 +377,7 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		r.ParseMultipartForm(maxMemory)
 	}
 
-	for _, header := range s.conf.DebugHTTPHeaders {
+	for _, header := range state.conf.DebugHTTPHeaders {
 		if value := r.Header.Get(header); value != "" {
 			log.Printf("%s: %s\n", header, value)
 		}
@@ -308,6 +457,8 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) findClientIP(r *http.Request) net.IP {
+	conf := s.stateFrom(r.Context()).conf
+
 	noEcs := r.URL.Query().Get("no_ecs")
 	if strings.EqualFold(noEcs, "true") {
 		return nil
@@ -327,7 +478,7 @@ func (s *Server) findClientIP(r *http.Request) net.IP {
 	if XRealIP != "" {
 		addr := strings.TrimSpace(XRealIP)
 		ip := net.ParseIP(addr)
-		if s.conf.ECSAllowNonGlobalIP || jsondns.IsGlobalIP(ip) {
+		if conf.ECSAllowNonGlobalIP || jsondns.IsGlobalIP(ip) {
 			return ip
 		}
 	}
@@ -337,12 +488,74 @@ func (s *Server) findClientIP(r *http.Request) net.IP {
 		return nil
 	}
 	ip := remoteAddr.IP
-	if s.conf.ECSAllowNonGlobalIP || jsondns.IsGlobalIP(ip) {
+	if conf.ECSAllowNonGlobalIP || jsondns.IsGlobalIP(ip) {
 		return ip
 	}
 	return nil
 }
 
+// logQuestion writes a query to stdout in the style of an access log.
+func logQuestion(client string, question *dns.Question) {
+	questionClass := ""
+	if qclass, ok := dns.ClassToString[question.Qclass]; ok {
+		questionClass = qclass
+	} else {
+		questionClass = strconv.FormatUint(uint64(question.Qclass), 10)
+	}
+	questionType := ""
+	if qtype, ok := dns.TypeToString[question.Qtype]; ok {
+		questionType = qtype
+	} else {
+		questionType = strconv.FormatUint(uint64(question.Qtype), 10)
+	}
+	fmt.Printf("%s - - [%s] \"%s %s %s\"\n", client, time.Now().Format("02/Jan/2006:15:04:05 -0700"), question.Name, questionClass, questionType)
+}
+
+// addClientSubnet adds an OPT record to msg if it has none and, unless the
+// client sent an EDNS Client Subnet option itself, one for the subnet of
+// clientIP, if known. It reports whether the answer is tailored to the
+// client, that is whether the client left the subnet to the server.
+func addClientSubnet(conf *config, msg *dns.Msg, clientIP net.IP) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		opt.SetDo(false)
+		msg.Extra = append([]dns.RR{opt}, msg.Extra...)
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0SUBNET {
+			return false
+		}
+	}
+	if clientIP == nil {
+		return true
+	}
+
+	edns0Subnet := new(dns.EDNS0_SUBNET)
+	edns0Subnet.Code = dns.EDNS0SUBNET
+	edns0Subnet.SourceScope = 0
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		edns0Subnet.Family = 1
+		edns0Subnet.SourceNetmask = 24
+		if conf.ECSUsePreciseIP {
+			edns0Subnet.SourceNetmask = 32
+		}
+		edns0Subnet.Address = ipv4.Mask(net.CIDRMask(int(edns0Subnet.SourceNetmask), 32))
+	} else {
+		edns0Subnet.Family = 2
+		edns0Subnet.SourceNetmask = 56
+		if conf.ECSUsePreciseIP {
+			edns0Subnet.SourceNetmask = 128
+		}
+		edns0Subnet.Address = clientIP.Mask(net.CIDRMask(int(edns0Subnet.SourceNetmask), 128))
+	}
+	opt.Option = append(opt.Option, edns0Subnet)
+	return true
+}
+
 // Workaround a bug causing Unbound to refuse returning anything about the root.
 func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 	for _, question := range req.request.Question {
@@ -354,7 +567,7 @@ func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 }
 
 // Return the position index for the question of qtype from a DNS msg, otherwise return -1.
-func (s *Server) indexQuestionType(msg *dns.Msg, qtype uint16) int {
+func indexQuestionType(msg *dns.Msg, qtype uint16) int {
 	for i, question := range msg.Question {
 		if question.Qtype == qtype {
 			return i
@@ -363,111 +576,283 @@ func (s *Server) indexQuestionType(msg *dns.Msg, qtype uint16) int {
 	return -1
 }
 
-func createCacheKey(req *DNSRequest) string {
-	if len(req.request.Question) == 0 {
-		return ""
-	}
-	q := req.request.Question[0]
-	return fmt.Sprintf("dns:%s:%d", strings.ToLower(q.Name), q.Qtype)
-}
-
 func (s *Server) doDNSQuery(ctx context.Context, req *DNSRequest) (err error) {
-	cacheKey := createCacheKey(req)
-	if cacheKey == "" {
+	keys, ok := newCacheKeys(req.request)
+	if !ok {
 		return fmt.Errorf("invalid DNS request: no question")
 	}
 
-	const cacheTTL = 300 // 5 minutes fixed TTL
+	// Hits are counted under the key of the entry answering, so that
+	// clients of different subnets sharing a global entry add up.
+	conf := s.stateFrom(ctx).conf
+	now := time.Now()
 
-	// Try to get from cache first if Redis is available
-	if s.redis != nil {
-		// Try to get fresh cache entry
-		if cachedResponse, err := s.redis.Get(ctx, cacheKey).Bytes(); err == nil {
-			msg := new(dns.Msg)
-			if err := msg.Unpack(cachedResponse); err == nil {
-				req.response = msg
-				req.fromCache = true
-				return nil
-			}
+	// Try to get from cache first
+	var stale *dns.Msg
+	var staleKey string
+	for _, cacheKey := range keys.lookup() {
+		cachedResponse, _, err := s.cache.Get(ctx, cacheKey)
+		if err != nil {
+			continue
 		}
-
-		// Check for stale entry
-		if cachedResponse, err := s.redis.Get(ctx, cacheKey+":stale").Bytes(); err == nil {
-			msg := new(dns.Msg)
-			if err := msg.Unpack(cachedResponse); err == nil {
-				req.response = msg
-				req.fromCache = true
-				// Trigger background refresh
-				go s.refreshCache(cacheKey, req.request)
-				return nil
+		msg, fresh, err := unpackCacheEntry(cachedResponse, now)
+		if err != nil {
+			continue
+		}
+		if fresh {
+			hits := s.countHit(conf, cacheKey, req, now)
+			storedAt, ttl, _ := cacheEntryHeader(cachedResponse)
+			if shouldPrefetch(conf, storedAt, ttl, hits, now) {
+				s.refreshCache(cacheKey, keys, req.request.Copy())
 			}
+			req.response = msg
+			req.fromCache = true
+			return nil
+		}
+		if stale == nil {
+			stale, staleKey = msg, cacheKey
 		}
 	}
 
 	// Cache miss - perform DNS query
-	if err := s.performDNSQuery(req); err != nil {
+	if stale == nil {
+		err = s.resolve(ctx, keys, req)
+	} else {
+		err = s.resolveOrServeStale(ctx, staleKey, keys, req, stale)
+	}
+	if err != nil {
 		return err
 	}
+	if req.fromCache {
+		s.countHit(conf, staleKey, req, now)
+	} else {
+		s.countHit(conf, keys.forResponse(req.response), req, now)
+	}
+	return nil
+}
 
-	// Cache successful response if Redis is available
-	if s.redis != nil && req.response != nil && len(req.response.Answer) > 0 {
-		// Store the exact response
-		if responseBinary, err := req.response.Pack(); err == nil {
-			// Store in both current and stale cache
-			s.redis.Set(ctx, cacheKey, responseBinary, time.Duration(cacheTTL)*time.Second)
-			s.redis.Set(ctx, cacheKey+":stale", responseBinary, time.Duration(cacheTTL*2)*time.Second)
+// resolveOrServeStale queries the upstreams for req, answering with stale, the
+// expired cache entry stored under staleKey, if they fail or do not answer
+// within cache_stale_client_timeout_ms (RFC 8767). In the latter case the
+// query goes on in the background and refreshes the cache when it completes.
+// There is at most one refresh per entry, requests arriving while it runs are
+// answered with stale right away.
+func (s *Server) resolveOrServeStale(ctx context.Context, staleKey string, keys cacheKeys, req *DNSRequest, stale *dns.Msg) error {
+	conf := s.stateFrom(ctx).conf
+	if _, running := s.refreshing.LoadOrStore(staleKey, true); running {
+		s.serveStale(conf, keys, req, stale)
+		return nil
+	}
+	fresh := &DNSRequest{
+		request: req.request,
+		refresh: true,
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer s.refreshing.Delete(staleKey)
+		done <- s.resolve(ctx, keys, fresh)
+	}()
+
+	var clientTimeout <-chan time.Time
+	if conf.CacheStaleClientTimeoutMS > 0 {
+		timer := time.NewTimer(time.Duration(conf.CacheStaleClientTimeoutMS) * time.Millisecond)
+		defer timer.Stop()
+		clientTimeout = timer.C
+	}
+	select {
+	case err := <-done:
+		if err == nil && fresh.response.Rcode != dns.RcodeServerFailure {
+			req.response = fresh.response
+			req.currentUpstream = fresh.currentUpstream
+			return nil
 		}
+	case <-clientTimeout:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
+	s.serveStale(conf, keys, req, stale)
 	return nil
 }
 
-func (s *Server) refreshCache(cacheKey string, request *dns.Msg) {
-	ctx := context.Background()
-	req := &DNSRequest{
-		request: request,
+// serveStale answers req with the expired cache entry stale.
+func (s *Server) serveStale(conf *config, keys cacheKeys, req *DNSRequest, stale *dns.Msg) {
+	if conf.Verbose {
+		log.Printf("Serving stale answer for %s\n", keys.global)
 	}
+	markStale(stale)
+	req.response = stale
+	req.fromCache = true
+}
 
-	if err := s.performDNSQuery(req); err != nil {
+// resolve queries the upstreams for req and caches the response. Identical
+// queries, those with the same cache keys, arriving while one is in flight
+// wait for its response instead of querying the upstreams again, and each
+// gets a copy with its own ID. The exchange is not cancelled when the client
+// that started it goes away, since others may be waiting for it.
+func (s *Server) resolve(ctx context.Context, keys cacheKeys, req *DNSRequest) error {
+	result, err, _ := s.queries.Do(keys.flight(), func() (any, error) {
+		ctx := context.WithoutCancel(ctx)
+		first := &DNSRequest{
+			request: req.request.Copy(),
+		}
+		if err := s.performDNSQuery(ctx, first); err != nil {
+			return nil, err
+		}
+		s.cacheResponse(ctx, keys, first.response, req.refresh)
+		return first, nil
+	})
+	if err != nil {
+		return err
+	}
+	first := result.(*DNSRequest)
+	req.response = first.response.Copy()
+	req.response.Id = req.request.Id
+	req.currentUpstream = first.currentUpstream
+	return nil
+}
+
+// cacheResponse caches response for as long as its TTLs allow, see cacheTTL,
+// and for cache_stale_max_age seconds more, during which it may be served
+// stale. If refresh is set, other replicas are told to drop the entry replaced.
+func (s *Server) cacheResponse(ctx context.Context, keys cacheKeys, response *dns.Msg, refresh bool) {
+	if response == nil {
+		return
+	}
+	conf := s.stateFrom(ctx).conf
+	ttl := cacheTTL(conf, response)
+	if ttl == 0 {
+		return
+	}
+	entry, err := packCacheEntry(conf, response, ttl, time.Now())
+	if err != nil {
 		return
 	}
+	lifetime := time.Duration(ttl+uint32(conf.CacheStaleMaxAge)) * time.Second
+	key := keys.forResponse(response)
+	if err := s.cache.Set(ctx, key, entry, lifetime); err != nil || !refresh {
+		return
+	}
+	if cache, ok := s.cache.(invalidatingCache); ok {
+		cache.Invalidate(ctx, key)
+	}
+}
 
-	if req.response != nil {
-		if responseBinary, err := req.response.Pack(); err == nil {
-			const cacheTTL = 300
-			s.redis.Set(ctx, cacheKey, responseBinary, time.Duration(cacheTTL)*time.Second)
-			s.redis.Set(ctx, cacheKey+":stale", responseBinary, time.Duration(cacheTTL*2)*time.Second)
+func (s *Server) performDNSQuery(ctx context.Context, req *DNSRequest) error {
+	state := s.stateFrom(ctx)
+	group := state.defaultGroup
+	if len(req.request.Question) > 0 {
+		group = state.groupFor(req.request.Question[0].Name)
+	}
+	tried := make(map[*upstream]bool, len(group.upstreams))
+	for i := uint(0); i < state.conf.Tries; i++ {
+		var u *upstream
+		var response *dns.Msg
+		var err error
+		if state.conf.UpstreamRace > 1 {
+			u, response, err = state.raceExchange(ctx, group, req.request, tried)
+		} else {
+			u = group.pickUpstream(tried)
+			tried[u] = true
+			response, err = state.timedExchange(ctx, u, req.request)
+		}
+		req.currentUpstream = u.name
+		if err == nil {
+			req.response = response
+			return nil
+		}
+		if _, ok := err.(*configError); ok {
+			return err
+		}
+		if isTLSVerificationError(err) {
+			log.Printf("TLS verification of upstream %s failed: %s\n", req.currentUpstream, err.Error())
+		} else {
+			log.Printf("DNS error from upstream %s: %s\n", req.currentUpstream, err.Error())
 		}
 	}
+	return fmt.Errorf("all upstream servers failed")
+}
+
+// timedExchange sends msg to u and records the result in the health of u,
+// unless ctx was cancelled before the upstream answered.
+func (st *serverState) timedExchange(ctx context.Context, u *upstream, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	response, err := st.exchange(ctx, u, msg)
+	if err == nil && response == nil {
+		err = fmt.Errorf("empty response")
+	}
+	if err == nil || ctx.Err() == nil {
+		st.observe(u, err, time.Since(start))
+	}
+	return response, err
 }
 
-func (s *Server) performDNSQuery(req *DNSRequest) error {
-	numServers := len(s.conf.Upstream)
-	for i := uint(0); i < s.conf.Tries; i++ {
-		req.currentUpstream = s.conf.Upstream[rand.Intn(numServers)]
-		upstream, t := addressAndType(req.currentUpstream)
+type raceResult struct {
+	upstream *upstream
+	response *dns.Msg
+	err      error
+}
 
-		var err error
-		switch t {
-		case "tcp-tls":
-			req.response, _, err = s.tcpClientTLS.ExchangeContext(context.Background(), req.request, upstream)
-		case "tcp", "udp":
-			if t == "tcp" || (s.indexQuestionType(req.request, dns.TypeAXFR) > -1) {
-				req.response, _, err = s.tcpClient.ExchangeContext(context.Background(), req.request, upstream)
-			} else {
-				req.response, _, err = s.udpClient.ExchangeContext(context.Background(), req.request, upstream)
-				if err == nil && req.response != nil && req.response.Truncated {
-					req.response, _, err = s.tcpClient.ExchangeContext(context.Background(), req.request, upstream)
-				}
+// raceExchange sends msg to upstream_race upstreams of group at once and
+// returns the first answer that is not SERVFAIL, cancelling the other
+// exchanges. If no upstream gives such an answer, a SERVFAIL answer is
+// returned if there was one, otherwise the last error.
+func (st *serverState) raceExchange(ctx context.Context, group *upstreamGroup, msg *dns.Msg, tried map[*upstream]bool) (*upstream, *dns.Msg, error) {
+	var racers []*upstream
+	for range st.conf.UpstreamRace {
+		u := group.pickUpstream(tried)
+		if tried[u] && len(racers) > 0 {
+			break
+		}
+		tried[u] = true
+		racers = append(racers, u)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(racers))
+	for _, u := range racers {
+		go func() {
+			response, err := st.timedExchange(ctx, u, msg.Copy())
+			results <- raceResult{upstream: u, response: response, err: err}
+		}()
+	}
+
+	var fallback *raceResult
+	for range racers {
+		result := <-results
+		if result.err == nil && result.response.Rcode != dns.RcodeServerFailure {
+			result.upstream.health.wins.Add(1)
+			if st.conf.Verbose {
+				log.Printf("Race won by upstream %s\n", result.upstream.name)
 			}
-		default:
-			return &configError{"invalid DNS type"}
+			return result.upstream, result.response, nil
+		}
+		if fallback == nil || (fallback.err != nil && result.err == nil) {
+			fallback = &result
 		}
+	}
+	return fallback.upstream, fallback.response, fallback.err
+}
 
-		if err == nil && req.response != nil {
-			return nil
+// How often the race win counts are logged.
+const raceWinsLogInterval = 5 * time.Minute
+
+// logRaceWins periodically logs how many races each upstream won since the
+// previous log line, while racing is enabled.
+func (s *Server) logRaceWins() {
+	last := make(map[string]uint64)
+	for range time.Tick(raceWinsLogInterval) {
+		state := s.state.Load()
+		if state.conf.UpstreamRace <= 1 {
+			continue
 		}
-		log.Printf("DNS error from upstream %s: %s\n", req.currentUpstream, err.Error())
+		var counts []string
+		for _, u := range state.upstreams {
+			wins := u.health.wins.Load()
+			counts = append(counts, fmt.Sprintf("%s=%d", u.name, wins-last[u.name]))
+			last[u.name] = wins
+		}
+		log.Printf("Race wins in the last %s: %s", raceWinsLogInterval, strings.Join(counts, ", "))
 	}
-	return fmt.Errorf("all upstream servers failed")
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolveCoalescesQueries(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		answerA(w, r)
+	})
+	server := &Server{cache: noopCache{}}
+	server.state.Store(newTestState(t, "random", "udp:"+addr))
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.Id = uint16(1000 + i)
+			req := &DNSRequest{request: msg}
+			if err := server.resolve(t.Context(), cacheKeys{global: "dns:example.com.:1:1:do=0:cd=0"}, req); err != nil {
+				t.Error(err)
+				return
+			}
+			if req.response.Id != msg.Id || len(req.response.Answer) != 1 {
+				t.Errorf("unexpected response %v", req.response)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d upstream queries for 20 identical requests, want 1", n)
+	}
+
+	// Once answered, the next query goes to the upstream again.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if err := server.resolve(t.Context(), cacheKeys{global: "dns:example.com.:1:1:do=0:cd=0"}, &DNSRequest{request: msg}); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d upstream queries after the flight completed, want 2", n)
+	}
+}
+
+func TestResolveOrServeStale(t *testing.T) {
+	t.Parallel()
+	var delay atomic.Int64
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(time.Duration(delay.Load()))
+		answerA(w, r)
+	})
+	server := &Server{cache: noopCache{}}
+	state := newTestState(t, "random", "udp:"+addr)
+	state.conf.Tries = 1
+	state.conf.CacheStaleClientTimeoutMS = 100
+	server.state.Store(state)
+
+	resolve := func(keys cacheKeys) *DNSRequest {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		stale := testResponse(0, 0)
+		req := &DNSRequest{request: msg}
+		if err := server.resolveOrServeStale(t.Context(), keys.global, keys, req, stale); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	// A working upstream answers fresh.
+	if req := resolve(cacheKeys{global: "dns:fast"}); req.fromCache || req.response.Answer[0].Header().Ttl != 60 {
+		t.Errorf("got stale answer %v from a working upstream", req.response)
+	}
+
+	// A slow upstream gets stale served after the client timeout, and is
+	// refreshed once, in the background, however many clients ask, from
+	// whichever subnets.
+	delay.Store(int64(500 * time.Millisecond))
+	before := queries.Load()
+	start := time.Now()
+	for i := range 3 {
+		req := resolve(cacheKeys{global: "dns:slow", subnet: "dns:slow:198.51.100." + strconv.Itoa(i) + "/32"})
+		if !req.fromCache || req.response.Answer[0].Header().Ttl != staleAnswerTTL {
+			t.Errorf("got %v from a slow upstream, want the stale answer", req.response)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 450*time.Millisecond {
+		t.Errorf("stale answers took %s", elapsed)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if n := queries.Load() - before; n != 1 {
+		t.Errorf("%d background refreshes, want 1", n)
+	}
+
+	// A failing upstream gets stale served right away.
+	state = newTestState(t, "random", "udp:127.0.0.1:1")
+	state.conf.Tries = 1
+	state.conf.CacheStaleClientTimeoutMS = 0
+	server.state.Store(state)
+	if req := resolve(cacheKeys{global: "dns:failing"}); !req.fromCache {
+		t.Errorf("got %v from a failing upstream, want the stale answer", req.response)
+	}
+}
+
+// recordingCache records the keys it is asked to invalidate.
+type recordingCache struct {
+	*memoryCache
+	mu          sync.Mutex
+	invalidated []string
+}
+
+func (c *recordingCache) Invalidate(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidated = append(c.invalidated, keys...)
+	return nil
+}
+
+func TestCacheResponseInvalidatesRefreshes(t *testing.T) {
+	t.Parallel()
+	cache := &recordingCache{memoryCache: newMemoryCache(10)}
+	server := &Server{cache: cache}
+	server.state.Store(newTestState(t, "random", "udp:192.0.2.1:53"))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	keys, _ := newCacheKeys(msg)
+	response := testResponse(300, 300)
+	response.Question = msg.Question
+
+	server.cacheResponse(t.Context(), keys, response, false)
+	if len(cache.invalidated) != 0 {
+		t.Errorf("first store invalidated %v", cache.invalidated)
+	}
+	server.cacheResponse(t.Context(), keys, response, true)
+	if len(cache.invalidated) != 1 || cache.invalidated[0] != keys.global {
+		t.Errorf("refresh invalidated %v, want [%s]", cache.invalidated, keys.global)
+	}
+	if cache.Stats().Sets != 2 || cache.Stats().Errors != 0 {
+		t.Errorf("stats %+v, want 2 sets and no errors", cache.Stats())
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// A cache snapshot starts with snapshotMagic, a version byte and the export
+// time in Unix milliseconds, followed by one record per entry: the key
+// length (2 bytes), key, entry length (4 bytes), entry as stored by
+// packCacheEntry and the milliseconds it had left to live (8 bytes). Integers
+// are big endian.
+const (
+	snapshotMagic   = "DOHCACHE"
+	snapshotVersion = 1
+)
+
+var errInvalidSnapshot = errors.New("not a cache snapshot")
+
+// exportCache writes every entry of cache to w as a snapshot and returns how
+// many it wrote.
+func exportCache(ctx context.Context, cache Cache, w io.Writer, now time.Time) (int, error) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	binary.Write(bw, binary.BigEndian, now.UnixMilli())
+
+	n := 0
+	err := cache.Range(ctx, "dns:*", func(key string, entry []byte, ttl time.Duration) error {
+		binary.Write(bw, binary.BigEndian, uint16(len(key)))
+		bw.WriteString(key)
+		binary.Write(bw, binary.BigEndian, uint32(len(entry)))
+		bw.Write(entry)
+		if err := binary.Write(bw, binary.BigEndian, uint64(ttl.Milliseconds())); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// importCache stores the entries of the snapshot read from r in cache, less
+// the time since the export, and returns how many it stored and how many had
+// expired meanwhile.
+func importCache(ctx context.Context, cache Cache, r io.Reader, now time.Time) (imported, expired int, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, 0, errInvalidSnapshot
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, 0, errInvalidSnapshot
+	}
+	if version := header[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, 0, fmt.Errorf("unsupported cache snapshot version %d", version)
+	}
+	exportedAt := time.UnixMilli(int64(binary.BigEndian.Uint64(header[len(snapshotMagic)+1:])))
+	onDisk := max(now.Sub(exportedAt), 0)
+
+	for {
+		var keyLen uint16
+		if err := binary.Read(br, binary.BigEndian, &keyLen); err == io.EOF {
+			return imported, expired, nil
+		} else if err != nil {
+			return imported, expired, err
+		}
+		key := make([]byte, keyLen)
+		var entryLen uint32
+		if _, err := io.ReadFull(br, key); err != nil {
+			return imported, expired, truncated(err)
+		}
+		if err := binary.Read(br, binary.BigEndian, &entryLen); err != nil {
+			return imported, expired, truncated(err)
+		}
+		entry := make([]byte, entryLen)
+		var ttlMillis uint64
+		if _, err := io.ReadFull(br, entry); err != nil {
+			return imported, expired, truncated(err)
+		}
+		if err := binary.Read(br, binary.BigEndian, &ttlMillis); err != nil {
+			return imported, expired, truncated(err)
+		}
+		if _, _, err := cacheEntryHeader(entry); err != nil {
+			return imported, expired, fmt.Errorf("entry %q: %w", key, err)
+		}
+
+		ttl := time.Duration(ttlMillis)*time.Millisecond - onDisk
+		if ttl <= 0 {
+			expired++
+			continue
+		}
+		if err := cache.Set(ctx, string(key), entry, ttl); err != nil {
+			return imported, expired, err
+		}
+		imported++
+	}
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// cacheSnapshot implements the cache-export and cache-import subcommands,
+// which copy the Redis cache of the configuration to and from a snapshot
+// file, "-" for standard output or input. It returns the process exit code.
+func cacheSnapshot(command string, args []string) int {
+	var configPath string
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&configPath, "conf", "", "configuration file path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [-conf path] file\n", os.Args[0], command)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+	cache, err := newCache(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+	// The memory cache lives and dies with this process.
+	if backend := cache.Stats().Backend; backend != "redis" && backend != "tiered" {
+		fmt.Fprintf(os.Stderr, "%s: Redis is not configured or not reachable, the cache backend is %q\n", command, backend)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if command == "cache-export" {
+		out := os.Stdout
+		if path != "-" {
+			if out, err = os.Create(path); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+				return 1
+			}
+		}
+		n, err := exportCache(ctx, cache, out, time.Now())
+		if err == nil && out != os.Stdout {
+			err = out.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d cache entries\n", n)
+		return 0
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		if in, err = os.Open(path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			return 1
+		}
+		defer in.Close()
+	}
+	imported, expired, err := importCache(ctx, cache, in, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v after %d entries\n", command, err, imported)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d cache entries, skipped %d expired ones\n", imported, expired)
+	return 0
+}
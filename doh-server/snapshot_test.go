@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	conf := defaultConfig()
+	now := time.Now()
+	src := newMemoryCache(10)
+	for key, ttl := range map[string]time.Duration{
+		"dns:example.com.:1:1:do=0:cd=0": time.Hour,
+		"dns:example.org.:1:1:do=0:cd=0": time.Minute,
+		"other":                          time.Hour,
+	} {
+		entry, err := packCacheEntry(conf, testResponse(300, 300), 300, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Set(ctx, key, entry, ttl)
+	}
+
+	var snapshot bytes.Buffer
+	n, err := exportCache(ctx, src, &snapshot, now)
+	if err != nil || n != 2 {
+		t.Fatalf("exportCache = %d, %v, want 2 entries", n, err)
+	}
+
+	// Ten minutes on disk expire the entry that had a minute left, and take
+	// ten minutes off the other.
+	dst := newMemoryCache(10)
+	imported, expired, err := importCache(ctx, dst, bytes.NewReader(snapshot.Bytes()), now.Add(10*time.Minute))
+	if err != nil || imported != 1 || expired != 1 {
+		t.Fatalf("importCache = %d, %d, %v, want 1 imported and 1 expired", imported, expired, err)
+	}
+	entry, ttl, err := dst.Get(ctx, "dns:example.com.:1:1:do=0:cd=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl > 50*time.Minute || ttl < 49*time.Minute {
+		t.Errorf("imported entry has %s left, want 50m", ttl)
+	}
+	if storedAt, _, err := cacheEntryHeader(entry); err != nil || storedAt.Unix() != now.Unix() {
+		t.Errorf("imported entry stored at %s, %v", storedAt, err)
+	}
+
+	if _, _, err := importCache(ctx, dst, bytes.NewReader([]byte("not a snapshot")), now); !errors.Is(err, errInvalidSnapshot) {
+		t.Errorf("importing garbage: %v", err)
+	}
+	truncated := snapshot.Bytes()[:snapshot.Len()-4]
+	if _, _, err := importCache(ctx, dst, bytes.NewReader(truncated), now); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("importing a truncated snapshot: %v", err)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream is a parsed entry of the upstream option.
+type upstream struct {
+	name     string
+	addr     string
+	typ      string
+	weight   int
+	priority int
+	health   *upstreamHealth
+
+	// TLS options of tcp-tls, https and quic upstreams
+	sni     string
+	tlsCA   string
+	tlsCert string
+	tlsKey  string
+	tlsPins []string
+
+	dotClient  *dns.Client
+	httpClient *http.Client
+	doq        *doqConn
+	pool       *connPool
+}
+
+// parseUpstream parses an entry of the upstream option. Options may follow
+// the address, separated by semicolons:
+//
+//	udp:192.0.2.1:53;weight=3;priority=1
+//	tcp-tls:10.0.0.5:853#resolver.internal;ca=/etc/ssl/internal.pem
+//
+// weight is used by the random and round_robin policies. Upstreams with a
+// lower priority value are preferred by every policy, the others are only
+// used once those were tried or ejected.
+//
+// tcp-tls and quic addresses may be followed by "#" and the name to send as
+// SNI and to verify the certificate against. TLS based upstreams accept the
+// ca, cert, key and pin options, which override upstream_tls_ca,
+// upstream_tls_cert, upstream_tls_key and upstream_tls_pins. pin may be
+// repeated.
+func parseUpstream(us string) (*upstream, error) {
+	base, options, hasOptions := strings.Cut(us, ";")
+	addr, t := addressAndType(base)
+	var sni string
+	switch t {
+	case "":
+		return nil, fmt.Errorf("missing protocol prefix, expected one of \"udp:\", \"tcp:\", \"tcp-tls:\", \"https:\" or \"quic:\"")
+	case "udp", "tcp":
+		if err := validateHostPort(addr); err != nil {
+			return nil, err
+		}
+	case "tcp-tls", "quic":
+		addr, sni, _ = strings.Cut(addr, "#")
+		if err := validateHostPort(addr); err != nil {
+			return nil, err
+		}
+	case "https":
+		// The address of a DoH upstream is its full URL.
+		addr = base
+		endpoint, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Host == "" || endpoint.Path == "" {
+			return nil, fmt.Errorf("expected a URL like \"https://dns.example/dns-query\"")
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", t)
+	}
+
+	u := &upstream{
+		name:   us,
+		addr:   addr,
+		typ:    t,
+		weight: 1,
+		sni:    sni,
+	}
+	if !hasOptions {
+		return u, nil
+	}
+	for _, option := range strings.Split(options, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "weight":
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid weight %q", value)
+			}
+			u.weight = int(n)
+		case "priority":
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority %q", value)
+			}
+			u.priority = int(n)
+		case "ca", "cert", "key", "pin":
+			if !u.usesTLS() {
+				return nil, fmt.Errorf("option %q is only valid for TLS based upstreams", key)
+			}
+			switch key {
+			case "ca":
+				u.tlsCA = value
+			case "cert":
+				u.tlsCert = value
+			case "key":
+				u.tlsKey = value
+			case "pin":
+				u.tlsPins = append(u.tlsPins, value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return u, nil
+}
+
+// upstreamHealth tracks the health of an upstream. It is shared by all states
+// that contain the same upstream, so a reload keeps the collected history.
+type upstreamHealth struct {
+	mu                   sync.Mutex
+	ejected              bool
+	consecutiveFailures  uint
+	consecutiveSuccesses uint
+	queries              uint64
+	failures             uint64
+	successRate          float64
+	latencyEWMA          float64
+	latencySamples       uint64
+	lastError            string
+	lastChange           time.Time
+	wins                 atomic.Uint64
+}
+
+// Weight of the latest result in the moving success rate and latency.
+const (
+	successRateAlpha = 0.1
+	latencyAlpha     = 0.3
+)
+
+// upstreamStatus is the JSON representation of an upstream on the status endpoint.
+type upstreamStatus struct {
+	Name                string    `json:"name"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures uint      `json:"consecutive_failures"`
+	SuccessRate         float64   `json:"success_rate"`
+	LatencyMs           float64   `json:"latency_ms"`
+	Queries             uint64    `json:"queries"`
+	Failures            uint64    `json:"failures"`
+	RaceWins            uint64    `json:"race_wins"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastChange          time.Time `json:"last_change"`
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{
+		successRate: 1,
+		lastChange:  time.Now(),
+	}
+}
+
+func (h *upstreamHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.ejected
+}
+
+// latency returns the moving average latency in nanoseconds, and whether it
+// has been measured at all.
+func (h *upstreamHealth) latency() (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latencyEWMA, h.latencySamples > 0
+}
+
+// observe records the result and round-trip time of a query or health check
+// sent to the upstream called name. The upstream is ejected after ejectAfter
+// consecutive failures and recovers after recoverAfter consecutive successes.
+// An ejectAfter of 0 disables ejection.
+func (h *upstreamHealth) observe(name string, err error, rtt time.Duration, ejectAfter, recoverAfter uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.queries++
+	if h.latencySamples == 0 {
+		h.latencyEWMA = float64(rtt)
+	} else {
+		h.latencyEWMA = (1-latencyAlpha)*h.latencyEWMA + latencyAlpha*float64(rtt)
+	}
+	h.latencySamples++
+	if err != nil {
+		h.failures++
+		h.consecutiveFailures++
+		h.consecutiveSuccesses = 0
+		h.successRate = (1 - successRateAlpha) * h.successRate
+		h.lastError = err.Error()
+		if !h.ejected && ejectAfter > 0 && h.consecutiveFailures >= ejectAfter {
+			h.ejected = true
+			h.lastChange = time.Now()
+			log.Printf("Upstream %s marked unhealthy after %d consecutive failures: %v", name, h.consecutiveFailures, err)
+		}
+		return
+	}
+
+	h.consecutiveSuccesses++
+	h.consecutiveFailures = 0
+	h.successRate = (1-successRateAlpha)*h.successRate + successRateAlpha
+	if h.ejected && h.consecutiveSuccesses >= recoverAfter {
+		h.ejected = false
+		h.lastChange = time.Now()
+		log.Printf("Upstream %s recovered after %d consecutive successes", name, h.consecutiveSuccesses)
+	}
+}
+
+func (h *upstreamHealth) status(name string) upstreamStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return upstreamStatus{
+		Name:                name,
+		Healthy:             !h.ejected,
+		ConsecutiveFailures: h.consecutiveFailures,
+		SuccessRate:         h.successRate,
+		LatencyMs:           h.latencyEWMA / float64(time.Millisecond),
+		Queries:             h.queries,
+		Failures:            h.failures,
+		RaceWins:            h.wins.Load(),
+		LastError:           h.lastError,
+		LastChange:          h.lastChange,
+	}
+}
+
+// healthRegistry hands out the upstreamHealth of each upstream by name.
+type healthRegistry struct {
+	mu     sync.Mutex
+	health map[string]*upstreamHealth
+}
+
+func (r *healthRegistry) get(name string) *upstreamHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.health == nil {
+		r.health = make(map[string]*upstreamHealth)
+	}
+	h, ok := r.health[name]
+	if !ok {
+		h = newUpstreamHealth()
+		r.health[name] = h
+	}
+	return h
+}
+
+// retain forgets the health of upstreams no longer in ups.
+func (r *healthRegistry) retain(ups []*upstream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keep := make(map[string]bool, len(ups))
+	for _, u := range ups {
+		keep[u.name] = true
+	}
+	for name := range r.health {
+		if !keep[name] {
+			delete(r.health, name)
+		}
+	}
+}
+
+func (u *upstream) usesTLS() bool {
+	return u.typ == "tcp-tls" || u.typ == "https" || u.typ == "quic"
+}
+
+// pickUpstream returns the upstream for the next try of a query, given the
+// upstreams already tried for it. Ejected upstreams are skipped unless every
+// upstream is ejected, so that queries still have a chance, and tried ones are
+// skipped until every healthy upstream was tried. Of the remaining upstreams,
+// those with the lowest priority value are handed to the selection policy.
+func (g *upstreamGroup) pickUpstream(tried map[*upstream]bool) *upstream {
+	var healthy, untried []*upstream
+	for _, u := range g.upstreams {
+		if !u.health.healthy() {
+			continue
+		}
+		healthy = append(healthy, u)
+		if !tried[u] {
+			untried = append(untried, u)
+		}
+	}
+	candidates := untried
+	if len(candidates) == 0 {
+		candidates = healthy
+	}
+	if len(candidates) == 0 {
+		candidates = g.upstreams
+	}
+
+	priority := candidates[0].priority
+	for _, u := range candidates {
+		priority = min(priority, u.priority)
+	}
+	preferred := make([]*upstream, 0, len(candidates))
+	for _, u := range candidates {
+		if u.priority == priority {
+			preferred = append(preferred, u)
+		}
+	}
+	return g.policy.pick(preferred)
+}
+
+// observe records the result of an exchange with u that took rtt. A failure
+// counts as taking the full timeout for latency purposes. Upstreams are only
+// ejected while health checking is enabled, since nothing would probe them
+// for recovery otherwise.
+func (st *serverState) observe(u *upstream, err error, rtt time.Duration) {
+	if err != nil {
+		rtt = max(rtt, time.Duration(st.conf.Timeout)*time.Second)
+	}
+	ejectAfter := st.conf.HealthCheckFailures
+	if st.conf.HealthCheckInterval == 0 {
+		ejectAfter = 0
+	}
+	u.health.observe(u.name, err, rtt, ejectAfter, st.conf.HealthCheckSuccesses)
+}
+
+// exchange sends msg to u and returns its response.
+func (st *serverState) exchange(ctx context.Context, u *upstream, msg *dns.Msg) (*dns.Msg, error) {
+	var resp *dns.Msg
+	var err error
+	switch u.typ {
+	case "tcp-tls":
+		resp, err = exchangeStream(ctx, u, u.dotClient, msg)
+	case "tcp", "udp":
+		if u.typ == "tcp" || (indexQuestionType(msg, dns.TypeAXFR) > -1) {
+			resp, err = exchangeStream(ctx, u, st.tcpClient, msg)
+		} else {
+			resp, _, err = st.udpClient.ExchangeContext(ctx, msg, u.addr)
+			if err == nil && resp != nil && resp.Truncated {
+				resp, err = exchangeStream(ctx, u, st.tcpClient, msg)
+			}
+		}
+	case "https":
+		resp, err = exchangeHTTPS(ctx, u, msg)
+	case "quic":
+		resp, err = u.doq.exchange(ctx, msg)
+	default:
+		return nil, &configError{"invalid DNS type"}
+	}
+	return resp, err
+}
+
+// exchangeStream sends msg to u over TCP or TLS, using the connection pool of
+// u if there is one. Zone transfers, which may span several messages, always
+// use a connection of their own.
+func exchangeStream(ctx context.Context, u *upstream, client *dns.Client, msg *dns.Msg) (*dns.Msg, error) {
+	if u.pool != nil && indexQuestionType(msg, dns.TypeAXFR) < 0 && indexQuestionType(msg, dns.TypeIXFR) < 0 {
+		return u.pool.exchange(ctx, msg)
+	}
+	resp, _, err := client.ExchangeContext(ctx, msg, u.addr)
+	return resp, err
+}
+
+// exchangeHTTPS sends msg to the DoH upstream u as an RFC 8484 POST request.
+// Connections, including HTTP/2 ones, are reused by the HTTP client of u.
+func exchangeHTTPS(ctx context.Context, u *upstream, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 section 4.1: the DNS ID should be 0 in DoH requests.
+	query := msg.Copy()
+	query.Id = 0
+	body, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("User-Agent", USER_AGENT)
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error from upstream: %s", resp.Status)
+	}
+	if contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); contentType != "application/dns-message" {
+		return nil, fmt.Errorf("unexpected Content-Type %q from upstream", resp.Header.Get("Content-Type"))
+	}
+	respBinary, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(respBinary); err != nil {
+		return nil, err
+	}
+	reply.Id = msg.Id
+	return reply, nil
+}
+
+// healthCheck probes every upstream of the current state at the configured
+// interval. It runs for the lifetime of the server and picks up reloads.
+func (s *Server) healthCheck() {
+	for {
+		state := s.state.Load()
+		interval := time.Duration(state.conf.HealthCheckInterval) * time.Second
+		if interval == 0 {
+			time.Sleep(configPollInterval)
+			continue
+		}
+		time.Sleep(interval)
+
+		state = s.state.Load()
+		if state.conf.HealthCheckInterval == 0 {
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, u := range state.upstreams {
+			wg.Go(func() {
+				start := time.Now()
+				err := state.probe(u)
+				state.observe(u, err, time.Since(start))
+			})
+		}
+		wg.Wait()
+	}
+}
+
+// probe sends the configured health check query to u. A SERVFAIL or REFUSED
+// answer counts as a failure.
+func (st *serverState) probe(u *upstream) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(st.conf.Timeout)*time.Second)
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(st.conf.HealthCheckName), dns.StringToType[st.conf.HealthCheckType])
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, err := st.exchange(ctx, u, msg)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return fmt.Errorf("health check answered with %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// startTestDNSServer serves handler over UDP and TCP on the same local port
+// and returns the address.
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	if err != nil {
+		tcpListener.Close()
+		t.Fatal(err)
+	}
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: handler}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: handler}
+	go tcpServer.ActivateAndServe()
+	go udpServer.ActivateAndServe()
+	t.Cleanup(func() {
+		tcpServer.Shutdown()
+		udpServer.Shutdown()
+	})
+	return tcpListener.Addr().String()
+}
+
+// answerA answers every question with an A record pointing to 192.0.2.1.
+func answerA(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range r.Question {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	w.WriteMsg(m)
+}
+
+func TestUpstreamHealthEjection(t *testing.T) {
+	t.Parallel()
+	h := newUpstreamHealth()
+	failure := errors.New("timeout")
+
+	h.observe("udp:192.0.2.1:53", failure, time.Second, 3, 2)
+	h.observe("udp:192.0.2.1:53", failure, time.Second, 3, 2)
+	if !h.healthy() {
+		t.Fatal("ejected before reaching the failure threshold")
+	}
+	h.observe("udp:192.0.2.1:53", failure, time.Second, 3, 2)
+	if h.healthy() {
+		t.Fatal("not ejected after 3 consecutive failures")
+	}
+	h.observe("udp:192.0.2.1:53", nil, time.Millisecond, 3, 2)
+	if h.healthy() {
+		t.Fatal("recovered before reaching the success threshold")
+	}
+	h.observe("udp:192.0.2.1:53", nil, time.Millisecond, 3, 2)
+	if !h.healthy() {
+		t.Fatal("not recovered after 2 consecutive successes")
+	}
+
+	status := h.status("udp:192.0.2.1:53")
+	if status.Queries != 5 || status.Failures != 3 || status.LastError != "timeout" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestPickUpstreamSkipsEjected(t *testing.T) {
+	t.Parallel()
+	addr := startTestDNSServer(t, answerA)
+
+	conf := defaultConfig()
+	conf.Upstream = []string{"udp:" + addr, "udp:127.0.0.1:1"}
+	conf.HealthCheckInterval = 1
+	conf.Timeout = 1
+	state, err := newServerState(conf, &healthRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, bad := state.upstreams[0], state.upstreams[1]
+
+	if err := state.probe(good); err != nil {
+		t.Fatalf("probe of working upstream failed: %v", err)
+	}
+	for i := uint(0); i < conf.HealthCheckFailures; i++ {
+		state.observe(bad, state.probe(bad), 0)
+	}
+	if bad.health.healthy() {
+		t.Fatal("unreachable upstream was not ejected")
+	}
+	for range 20 {
+		if u := state.defaultGroup.pickUpstream(nil); u != good {
+			t.Fatalf("picked ejected upstream %s", u.name)
+		}
+	}
+}
+
+func TestRaceExchange(t *testing.T) {
+	t.Parallel()
+	slow := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		answerA(w, r)
+	})
+	failing := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	fast := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(20 * time.Millisecond)
+		answerA(w, r)
+	})
+
+	state := newTestState(t, "failover", "udp:"+slow, "udp:"+failing, "udp:"+fast)
+	state.conf.UpstreamRace = 3
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	u, response, err := state.raceExchange(t.Context(), state.defaultGroup, msg, map[*upstream]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("race took %s, slow upstream was waited for", elapsed)
+	}
+	if u != state.upstreams[2] || response.Rcode != dns.RcodeSuccess {
+		t.Errorf("race won by %s with %s", u.name, dns.RcodeToString[response.Rcode])
+	}
+	if wins := u.health.wins.Load(); wins != 1 {
+		t.Errorf("wins = %d", wins)
+	}
+
+	// Without a usable answer, the SERVFAIL answer is returned.
+	state = newTestState(t, "failover", "udp:"+failing, "udp:127.0.0.1:1")
+	state.conf.UpstreamRace = 2
+	_, response, err = state.raceExchange(t.Context(), state.defaultGroup, msg, map[*upstream]bool{})
+	if err != nil || response.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL answer, got %v, %v", response, err)
+	}
+}
+
+// startTestDoHServer serves RFC 8484 POST requests over HTTP/2 with handler
+// and returns the URL of its endpoint and a CA file trusting its certificate.
+func startTestDoHServer(t *testing.T, handler dns.HandlerFunc) (string, string) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || r.ProtoMajor != 2 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil || msg.Id != 0 {
+			http.Error(w, "invalid DNS message", http.StatusBadRequest)
+			return
+		}
+		rw := &testResponseWriter{}
+		handler(rw, msg)
+		respBinary, _ := rw.msg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(respBinary)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return server.URL + "/dns-query", caFile
+}
+
+// testResponseWriter captures the message written by a dns.Handler.
+type testResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	t.Parallel()
+	endpoint, caFile := startTestDoHServer(t, answerA)
+
+	state := newTestState(t, "random", endpoint+";ca="+caFile)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	req := &DNSRequest{request: msg}
+	server := &Server{}
+	server.state.Store(state)
+	if err := server.performDNSQuery(t.Context(), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.response.Id != msg.Id || len(req.response.Answer) != 1 {
+		t.Errorf("unexpected response %v", req.response)
+	}
+	if req.currentUpstream != endpoint+";ca="+caFile {
+		t.Errorf("currentUpstream = %q", req.currentUpstream)
+	}
+
+	// The upstream is tried tries times, each bounded by timeout.
+	slow, caFile := startTestDoHServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(1500 * time.Millisecond)
+		answerA(w, r)
+	})
+	state = newTestState(t, "random", slow+";ca="+caFile)
+	state.conf.Tries = 2
+	state.upstreams[0].httpClient.Timeout = 100 * time.Millisecond
+	server.state.Store(state)
+	start := time.Now()
+	if err := server.performDNSQuery(t.Context(), &DNSRequest{request: msg}); err == nil {
+		t.Error("expected timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("tries took %s", elapsed)
+	}
+	if status := state.upstreams[0].health.status(""); status.Failures != 2 {
+		t.Errorf("failures = %d", status.Failures)
+	}
+}
+
+// startTestDoQServer serves DNS-over-QUIC with handler and returns the
+// address and a CA file trusting its certificate.
+func startTestDoQServer(t *testing.T, handler dns.HandlerFunc) (string, string) {
+	t.Helper()
+	certFile, keyFile := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						var length uint16
+						if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+							return
+						}
+						query := make([]byte, length)
+						if _, err := io.ReadFull(stream, query); err != nil {
+							return
+						}
+						msg := new(dns.Msg)
+						if err := msg.Unpack(query); err != nil || msg.Id != 0 {
+							stream.CancelWrite(0x2)
+							return
+						}
+						rw := &testResponseWriter{}
+						handler(rw, msg)
+						reply, _ := rw.msg.Pack()
+						binary.Write(stream, binary.BigEndian, uint16(len(reply)))
+						stream.Write(reply)
+					}()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), certFile
+}
+
+func TestQUICUpstream(t *testing.T) {
+	t.Parallel()
+	addr, caFile := startTestDoQServer(t, answerA)
+
+	state := newTestState(t, "random", "quic:"+addr+";ca="+caFile)
+	defer state.close()
+
+	for range 3 {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		reply, err := state.exchange(t.Context(), state.upstreams[0], msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Id != msg.Id || len(reply.Answer) != 1 {
+			t.Errorf("unexpected reply %v", reply)
+		}
+	}
+
+	// The connection is reused, and replaced once the upstream closes it.
+	doq := state.upstreams[0].doq
+	conn := doq.conn
+	conn.CloseWithError(0, "")
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := state.exchange(t.Context(), state.upstreams[0], msg); err != nil {
+		t.Fatal(err)
+	}
+	if doq.conn == conn {
+		t.Error("closed connection was not replaced")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// upstreamTLSConfig builds the TLS configuration used to reach the TLS based
+// upstream u. The options of u take precedence over the upstream_tls_*
+// options of conf.
+func upstreamTLSConfig(conf *config, u *upstream) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: u.sni,
+	}
+	if tlsConfig.ServerName == "" {
+		if u.typ == "https" {
+			// The address of DoH upstreams is their URL.
+			if endpoint, err := url.Parse(u.addr); err == nil {
+				tlsConfig.ServerName = endpoint.Hostname()
+			}
+		} else if host, _, err := net.SplitHostPort(u.addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if caFile := cmp.Or(u.tlsCA, conf.UpstreamTLSCA); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no PEM encoded certificate found in upstream CA %s", caFile)
+		}
+	}
+
+	certFile, keyFile := cmp.Or(u.tlsCert, conf.UpstreamTLSCert), cmp.Or(u.tlsKey, conf.UpstreamTLSKey)
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	pins := u.tlsPins
+	if len(pins) == 0 {
+		pins = conf.UpstreamTLSPins
+	}
+	if len(pins) != 0 {
+		hashes, err := parseSPKIPins(pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, hashes)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseSPKIPins decodes pins of the form "sha256/<base64>", as used by HPKP
+// and `openssl x509 -pubkey | openssl pkey -pubin -outform der | openssl dgst
+// -sha256 -binary | base64`. The "sha256/" prefix is optional.
+func parseSPKIPins(pins []string) ([][]byte, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q, expected \"sha256/\" followed by a base64 encoded SHA-256 hash", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// pinError is returned when no certificate presented by an upstream matches
+// the configured SPKI pins.
+type pinError struct {
+	serverName string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("no certificate presented by %s matches the configured SPKI pins", e.serverName)
+}
+
+// verifySPKIPins accepts the connection if any certificate of the chain
+// presented by the server matches one of hashes. It runs after, not instead
+// of, the usual certificate verification.
+func verifySPKIPins(cs tls.ConnectionState, hashes [][]byte) error {
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, hash := range hashes {
+			if subtle.ConstantTimeCompare(sum[:], hash) == 1 {
+				return nil
+			}
+		}
+	}
+	return &pinError{serverName: cs.ServerName}
+}
+
+// isTLSVerificationError reports whether err is caused by an upstream
+// certificate that failed verification or pinning.
+func isTLSVerificationError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var pinErr *pinError
+	return errors.As(err, &verificationErr) || errors.As(err, &pinErr)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDoTServer serves DNS-over-TLS with answerA, requiring a client
+// certificate issued by clientCAFile, and returns its address.
+func startTestDoTServer(t *testing.T, certFile, keyFile, clientCAFile string) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCA)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: dns.HandlerFunc(answerA)}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String()
+}
+
+func TestDoTUpstreamTLSOptions(t *testing.T) {
+	t.Parallel()
+	serverCert, serverKey := writeTestCertificate(t)
+	clientCert, clientKey := writeTestCertificate(t)
+	otherCert, _ := writeTestCertificate(t)
+	addr := startTestDoTServer(t, serverCert, serverKey, clientCert)
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	clientOptions := ";cert=" + clientCert + ";key=" + clientKey
+
+	for _, tc := range []struct {
+		name              string
+		upstream          string
+		verificationError bool
+	}{
+		{"sni and pin", "tcp-tls:" + addr + "#localhost;ca=" + serverCert + clientOptions + ";pin=" + wrongPin + ";pin=" + pin, false},
+		{"ip address", "tcp-tls:" + addr + ";ca=" + serverCert + clientOptions, false},
+		{"wrong pin", "tcp-tls:" + addr + "#localhost;ca=" + serverCert + clientOptions + ";pin=" + wrongPin, true},
+		{"untrusted CA", "tcp-tls:" + addr + "#localhost;ca=" + otherCert + clientOptions, true},
+		{"wrong sni", "tcp-tls:" + addr + "#resolver.internal;ca=" + serverCert + clientOptions, true},
+		{"no client certificate", "tcp-tls:" + addr + "#localhost;ca=" + serverCert, false},
+	} {
+		state := newTestState(t, "random", tc.upstream)
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		_, err := state.exchange(t.Context(), state.upstreams[0], msg)
+		if got := isTLSVerificationError(err); got != tc.verificationError {
+			t.Errorf("%s: isTLSVerificationError(%v) = %v", tc.name, err, got)
+		}
+		if tc.name == "no client certificate" {
+			if err == nil {
+				t.Errorf("%s: expected the server to reject the connection", tc.name)
+			}
+		} else if !tc.verificationError && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestUpstreamTLSServerName(t *testing.T) {
+	t.Parallel()
+	for upstream, want := range map[string]string{
+		"tcp-tls:dns.example:853":            "dns.example",
+		"quic:[2001:db8::53]:853":            "2001:db8::53",
+		"https://dns.example/dns-query":      "dns.example",
+		"https://dns.example:8443/dns-query": "dns.example",
+		"https://[2001:db8::53]/dns-query":   "2001:db8::53",
+		"tcp-tls:192.0.2.53:853#dns.example": "dns.example",
+	} {
+		u, err := parseUpstream(upstream)
+		if err != nil {
+			t.Fatalf("%s: %v", upstream, err)
+		}
+		tlsConfig, err := upstreamTLSConfig(defaultConfig(), u)
+		if err != nil {
+			t.Fatalf("%s: %v", upstream, err)
+		}
+		if tlsConfig.ServerName != want {
+			t.Errorf("%s: ServerName = %q, want %q", upstream, tlsConfig.ServerName, want)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	t.Parallel()
+	certFile, keyFile := writeTestCertificate(t)
+
+	for _, us := range []string{
+		"tcp-tls:192.0.2.1:853;ca=/nonexistent.pem",
+		"tcp-tls:192.0.2.1:853;ca=" + keyFile,
+		"tcp-tls:192.0.2.1:853;cert=" + certFile,
+		"tcp-tls:192.0.2.1:853;pin=sha256/AAAA",
+	} {
+		conf := defaultConfig()
+		conf.Upstream = []string{us}
+		if errs := validateConfig(conf); len(errs) == 0 {
+			t.Errorf("expected error for %q", us)
+		}
+	}
+
+	if _, err := parseUpstream("udp:192.0.2.1:53;ca=" + certFile); err == nil {
+		t.Error("expected TLS option to be rejected for udp upstream")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// How often warm-up progress is logged.
+const warmupLogInterval = 5 * time.Second
+
+// readWarmupFile reads the questions of a warm-up file: one name per line,
+// followed by a type which defaults to A. Empty lines and lines starting with
+// '#' are skipped. The /cache/top admin endpoint writes this format.
+func readWarmupFile(path string) ([]dns.Question, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var questions []dns.Question
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a name and a type", line)
+		}
+		name := dns.CanonicalName(fields[0])
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("line %d: %q is not a valid domain name", line, fields[0])
+		}
+		qtype := dns.TypeA
+		if len(fields) == 2 {
+			var ok bool
+			if qtype, ok = parseType(fields[1]); !ok {
+				return nil, fmt.Errorf("line %d: unknown type %q", line, fields[1])
+			}
+		}
+		questions = append(questions, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	return questions, scanner.Err()
+}
+
+// parseType parses a type mnemonic, or the TYPEnnn form of RFC 3597 for
+// types without one.
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if qtype, ok := dns.StringToType[s]; ok {
+		return qtype, true
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		qtype, err := strconv.ParseUint(n, 10, 16)
+		return uint16(qtype), err == nil
+	}
+	return 0, false
+}
+
+// warmCache resolves the questions of warmup_file, warmup_concurrency at a
+// time, so that they are cached before the server starts listening. Entries
+// already in a shared cache are only copied to the memory cache. After
+// warmup_timeout seconds it gives up waiting, queries in flight complete in
+// the background.
+func (s *Server) warmCache(ctx context.Context) {
+	conf := s.state.Load().conf
+	if conf.WarmupFile == "" {
+		return
+	}
+	questions, err := readWarmupFile(conf.WarmupFile)
+	if err != nil {
+		log.Printf("Cache warm-up skipped: %s: %v", conf.WarmupFile, err)
+		return
+	}
+
+	log.Printf("Cache warm-up: resolving %d names from %s", len(questions), conf.WarmupFile)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.WarmupTimeout)*time.Second)
+	defer cancel()
+	start := time.Now()
+	var done, failed atomic.Int64
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var g errgroup.Group
+		g.SetLimit(int(conf.WarmupConcurrency))
+		for _, q := range questions {
+			if ctx.Err() != nil {
+				break
+			}
+			g.Go(func() error {
+				defer done.Add(1)
+				if err := s.warmQuestion(ctx, q); err != nil {
+					failed.Add(1)
+					if conf.Verbose {
+						log.Printf("Cache warm-up: %s %s: %v", q.Name, dns.Type(q.Qtype), err)
+					}
+				}
+				return nil
+			})
+		}
+		g.Wait()
+	}()
+
+	ticker := time.NewTicker(warmupLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Cache warm-up: %d of %d names resolved", done.Load(), len(questions))
+		case <-finished:
+			log.Printf("Cache warm-up: %d names resolved in %s, %d failed",
+				len(questions), time.Since(start).Round(time.Millisecond), failed.Load())
+			return
+		case <-ctx.Done():
+			log.Printf("Cache warm-up: gave up after %s, %d of %d names resolved, %d failed",
+				time.Since(start).Round(time.Millisecond), done.Load(), len(questions), failed.Load())
+			return
+		}
+	}
+}
+
+// warmQuestion resolves q into the cache with and without the DO bit, the
+// variants asked for by the JSON API and by most DNS wire format clients,
+// which both send an OPT record.
+func (s *Server) warmQuestion(ctx context.Context, q dns.Question) error {
+	for _, do := range []bool{false, true} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.Name, q.Qtype)
+		msg.SetEdns0(dns.DefaultMsgSize, do)
+		req := &DNSRequest{
+			request: msg,
+			warmup:  true,
+		}
+		if err := s.doDNSQuery(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
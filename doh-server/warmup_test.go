@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func writeWarmupFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warmup.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadWarmupFile(t *testing.T) {
+	path := writeWarmupFile(t, "# popular names\nexample.com\n\nwww.example.com. aaaa\nexample.org TYPE65400\n")
+	questions, err := readWarmupFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dns.Question{
+		{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "www.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: 65400, Qclass: dns.ClassINET},
+	}
+	if len(questions) != len(want) {
+		t.Fatalf("got %v, want %v", questions, want)
+	}
+	for i := range want {
+		if questions[i] != want[i] {
+			t.Errorf("question %d: got %v, want %v", i, questions[i], want[i])
+		}
+	}
+
+	for _, content := range []string{"example.com A extra\n", "example.com BOGUS\n", "exa..mple.com\n"} {
+		if _, err := readWarmupFile(writeWarmupFile(t, content)); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA(w, r)
+	})
+	server := &Server{cache: newMemoryCache(100)}
+	state := newTestState(t, "random", "udp:"+addr)
+	state.conf.AdminToken = "s3cret"
+	state.conf.WarmupFile = writeWarmupFile(t, "example.com\nexample.net\nexample.org\n")
+	state.conf.WarmupConcurrency = 2
+	server.state.Store(state)
+
+	// Every name is warmed with and without the DO bit.
+	server.warmCache(t.Context())
+	if n := queries.Load(); n != 6 {
+		t.Errorf("%d upstream queries, want 6", n)
+	}
+	if stats := server.cache.Stats(); stats.Entries != 6 {
+		t.Errorf("%d cache entries after warm-up, want 6", stats.Entries)
+	}
+
+	// JSON API queries, which set the DO bit, are answered from the cache.
+	// The most queried names make a warm-up file for other replicas, warm-up
+	// queries do not count.
+	for range 2 {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Example.NET.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		req := &DNSRequest{request: msg}
+		if err := server.doDNSQuery(t.Context(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !req.fromCache {
+			t.Error("DO=1 query not answered from the warmed cache")
+		}
+	}
+	req := httptest.NewRequest("GET", "/cache/top?limit=2", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Body.String(), "example.net. A\n"; got != want {
+		t.Errorf("got top names %q, want %q", got, want)
+	}
+	questions, err := readWarmupFile(writeWarmupFile(t, w.Body.String()))
+	if err != nil || len(questions) != 1 {
+		t.Errorf("top names do not read back as warm-up file: %v, %v", questions, err)
+	}
+}
+
+func TestWarmCacheTimeout(t *testing.T) {
+	t.Parallel()
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(3 * time.Second)
+		answerA(w, r)
+	})
+	server := &Server{cache: newMemoryCache(100)}
+	state := newTestState(t, "random", "udp:"+addr)
+	state.conf.WarmupFile = writeWarmupFile(t, "example.com\nexample.net\nexample.org\n")
+	state.conf.WarmupConcurrency = 1
+	state.conf.WarmupTimeout = 1
+	server.state.Store(state)
+
+	start := time.Now()
+	server.warmCache(t.Context())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("warm-up took %s with warmup_timeout = 1", elapsed)
+	}
+}